@@ -1,15 +1,5 @@
 package nprotoo
 
-// Error .
-type Error struct {
-	Code   int
-	Reason string
-}
-
-func (e Error) Error() string {
-	return e.Reason
-}
-
 // Future .
 type Future struct {
 	c      chan struct{}
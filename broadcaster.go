@@ -2,41 +2,77 @@ package nprotoo
 
 import (
 	"encoding/json"
+	"sync"
 
 	"github.com/chuckpreslar/emission"
 	"github.com/cloudwebrtc/nats-protoo/logger"
-	nats "github.com/nats-io/nats.go"
 )
 
 // Broadcaster .
 type Broadcaster struct {
+	// Deprecated: use the typed callbacks or Events instead.
 	emission.Emitter
-	subj string
-	np   *NatsProtoo
+	*eventHub
+	subj        string
+	np          *NatsProtoo
+	unsubscribe func()
+	closed      bool
+	durable     bool
+	replay      *replayBuffer
+	replaySub   TransportSubscription
+	mutex       sync.Mutex
 }
 
-func newBroadcaster(subj string, np *NatsProtoo, nc *nats.Conn) *Broadcaster {
+func newBroadcaster(subj string, np *NatsProtoo) *Broadcaster {
 	var bc Broadcaster
 	bc.Emitter = *emission.NewEmitter()
+	bc.eventHub = newEventHub(&bc.Emitter)
 	bc.subj = subj
 	bc.np = np
-	bc.np.On("close", func(code int, err string) {
-		logger.Infof("Transport closed [%d] %s", code, err)
-		bc.Emit("close", code, err)
-	})
-	bc.np.On("error", func(code int, err string) {
-		logger.Warnf("Transport got error (%d, %s)", code, err)
-		bc.Emit("error", code, err)
+	bc.unsubscribe = bc.np.subscribe(func(e Event) {
+		switch ev := e.(type) {
+		case CloseEvent:
+			logger.Infof("Transport closed [%d] %s", ev.Code, ev.Reason)
+		case ErrorEvent:
+			logger.Warnf("Transport got error (%d, %s)", ev.Code, ev.Reason)
+		}
+		bc.emit(e)
 	})
 	return &bc
 }
 
-// Say .
-func (bc *Broadcaster) Say(method string, data interface{}) {
+// Close detaches the broadcaster from its NatsProtoo, Say does nothing afterwards.
+func (bc *Broadcaster) Close() {
+	bc.mutex.Lock()
+	if bc.closed {
+		bc.mutex.Unlock()
+		return
+	}
+	bc.closed = true
+	replaySub := bc.replaySub
+	bc.mutex.Unlock()
+	bc.unsubscribe()
+	if replaySub != nil {
+		replaySub.Unsubscribe()
+	}
+	logger.Debugf("Broadcaster closed [%s]", bc.subj)
+	bc.emit(CloseEvent{Reason: "broadcaster closed"})
+}
+
+// Say sends a notification on the channel, durable broadcasters return
+// the JetStream publish ack, others a nil ack.
+func (bc *Broadcaster) Say(method string, data interface{}) (*PubAck, error) {
+	bc.mutex.Lock()
+	closed, replay := bc.closed, bc.replay
+	bc.mutex.Unlock()
+	if closed {
+		logger.Warnf("Say [%s] on closed broadcaster %s", method, bc.subj)
+		return nil, ErrTransportClosed
+	}
 	dataStr, err := json.Marshal(data)
 	if err != nil {
 		logger.Errorf("Marshal data %v", err)
-		return
+		return nil, &Error{Code: BadRequestCode, Reason: err.Error(), cause: err}
 	}
 	notification := &Notification{
 		NotificationData: NotificationData{
@@ -47,11 +83,19 @@ func (bc *Broadcaster) Say(method string, data interface{}) {
 			Data:   dataStr,
 		},
 	}
+	notification.Seq = bc.np.nextSequence(bc.subj)
+	notification.Publisher = bc.np.publisherID
 	str, err := json.Marshal(notification)
 	if err != nil {
 		logger.Errorf("Marshal %v", err)
-		return
+		return nil, &Error{Code: BadRequestCode, Reason: err.Error(), cause: err}
 	}
 	logger.Debugf("Send notification [%s]", method)
-	bc.np.Send(str, bc.subj, _EMPTY_)
+	if replay != nil {
+		replay.add(notification.Seq, str)
+	}
+	if bc.durable {
+		return bc.np.publishDurable(bc.subj, str)
+	}
+	return nil, bc.np.Send(str, bc.subj, _EMPTY_)
 }
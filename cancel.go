@@ -0,0 +1,158 @@
+package nprotoo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
+)
+
+const (
+	// CancelSubjectPrefix prefixes the channel of a request in the subject
+	// its cancel is sent on.
+	CancelSubjectPrefix = "_NPROTOO.CANCEL."
+
+	earlyCancelTTL = time.Minute
+)
+
+// RequestContext sends a request which is abandoned when ctx is done, the
+// listener is notified so that the context of the request is cancelled.
+// Cancels travel on CancelSubjectPrefix + channel rather than the channel
+// itself, so a listener blocking until Request.Context is done sees them.
+func (req *Requestor) RequestContext(ctx context.Context, method string, data interface{}, success AcceptFunc, reject RejectFunc) {
+	req.request(ctx, method, data, _EMPTY_, success, func(err *Error) {
+		reject(err.Code, err.Reason)
+	})
+}
+
+// SyncRequestContext .
+func (req *Requestor) SyncRequestContext(ctx context.Context, method string, data interface{}) (RawMessage, *Error) {
+	return req.AsyncRequestContext(ctx, method, data).Await()
+}
+
+type peerKey struct{}
+
+// WithPeer returns a context whose requests carry peer as Request.Peer.
+func WithPeer(ctx context.Context, peer string) context.Context {
+	return context.WithValue(ctx, peerKey{}, peer)
+}
+
+func peerFromContext(ctx context.Context) string {
+	peer, _ := ctx.Value(peerKey{}).(string)
+	return peer
+}
+
+func (req *Requestor) watchContext(ctx context.Context, transcation *Transcation) {
+	select {
+	case <-transcation.settled:
+		return
+	case <-ctx.Done():
+	}
+	if req.remove(transcation.id) == nil {
+		return
+	}
+	transcation.timer.Stop()
+	logger.Debugf("Request cancelled transcation[%d], method[%s]", transcation.id, transcation.method)
+	req.sendCancel(transcation)
+	transcation.reject(ErrCancelled.Wrap(ctx.Err()))
+}
+
+// sendCancel tells the listener to stop working on an abandoned request.
+func (req *Requestor) sendCancel(transcation *Transcation) {
+	cancel := &Cancel{
+		CancelData: CancelData{
+			Cancel: true,
+		},
+		CommonData: CommonData{
+			ID:     transcation.id,
+			Method: transcation.method,
+		},
+	}
+	payload, err := json.Marshal(cancel)
+	if err != nil {
+		logger.Errorf("Marshal %v", err)
+		return
+	}
+	req.np.Send(payload, CancelSubjectPrefix+req.subj, req.reply)
+}
+
+// subscribeCancel subscribes the cancel subject of channel, the caller must
+// hold np.mutex. Cancels are delivered apart from requests, so that they
+// reach listeners blocking the channel subscription.
+func (np *NatsProtoo) subscribeCancel(channel string) {
+	subj := CancelSubjectPrefix + channel
+	if _, found := np.channelSubs[subj]; found {
+		return
+	}
+	sub, err := np.transport.Subscribe(subj, func(msg *Msg) {
+		var peerMsg PeerMsg
+		if err := json.Unmarshal(msg.Data, &peerMsg); err != nil || !peerMsg.Cancel {
+			logger.Errorf("Invalid cancel on %s", msg.Subject)
+			return
+		}
+		np.handleCancel(peerMsg.ToCancel(), strings.TrimPrefix(msg.Subject, CancelSubjectPrefix), msg.Reply)
+	})
+	if err != nil {
+		logger.Errorf("Subscribe %s %v", subj, err)
+		return
+	}
+	np.channelSubs[subj] = sub
+}
+
+func inflightKey(subj string, reply string, id int) string {
+	return fmt.Sprintf("%s:%s:%d", subj, reply, id)
+}
+
+// track attaches a cancellable context to the request, done must be called
+// once the request is answered.
+func (np *NatsProtoo) track(msg *Request, subj string, reply string) (done func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	msg.ctx = ctx
+	key := inflightKey(subj, reply, msg.ID)
+	np.mutex.Lock()
+	if _, early := np.cancelled[key]; early {
+		delete(np.cancelled, key)
+		cancel()
+	} else {
+		np.inflight[key] = cancel
+	}
+	np.mutex.Unlock()
+	return func() {
+		np.mutex.Lock()
+		delete(np.inflight, key)
+		np.mutex.Unlock()
+		cancel()
+	}
+}
+
+func (np *NatsProtoo) handleCancel(msg Cancel, subj string, reply string) {
+	key := inflightKey(subj, reply, msg.ID)
+	np.mutex.Lock()
+	cancel, found := np.inflight[key]
+	delete(np.inflight, key)
+	if !found {
+		// The request may still be queued behind a busy listener.
+		np.rememberCancel(key, time.Now())
+	}
+	np.mutex.Unlock()
+	if !found {
+		logger.Debugf("Cancel for unknown request [%s] id:%d", msg.Method, msg.ID)
+		return
+	}
+	logger.Debugf("Cancel request [%s] id:%d", msg.Method, msg.ID)
+	cancel()
+}
+
+// rememberCancel keeps a cancel that arrived before its request, the
+// caller must hold np.mutex.
+func (np *NatsProtoo) rememberCancel(key string, now time.Time) {
+	for k, at := range np.cancelled {
+		if now.Sub(at) > earlyCancelTTL {
+			delete(np.cancelled, k)
+		}
+	}
+	np.cancelled[key] = now
+}
@@ -0,0 +1,211 @@
+package nprotoo
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// CircuitOpenCode is the error code of requests failed fast by an open
+	// circuit, outside the HTTP codes so that it is not taken for a reject.
+	CircuitOpenCode = 590
+
+	// DefaultCircuitThreshold .
+	DefaultCircuitThreshold = 5
+	// DefaultCircuitWindow .
+	DefaultCircuitWindow = 30 * time.Second
+	// DefaultCircuitOpenTimeout .
+	DefaultCircuitOpenTimeout = 10 * time.Second
+)
+
+// CircuitState .
+type CircuitState string
+
+const (
+	// CircuitClosed lets all requests through.
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen fails all requests immediately.
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen lets a limited number of probe requests through.
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// CircuitBreakerConfig .
+type CircuitBreakerConfig struct {
+	// Threshold is the number of timeouts or 5xx rejects within Window
+	// that trips the breaker. Errors raised locally other than timeouts,
+	// e.g. on disconnect or cancel, are not counted either way.
+	Threshold int
+	Window    time.Duration
+	// OpenTimeout is how long the breaker stays open before probing.
+	OpenTimeout time.Duration
+	// Probes is the number of concurrent requests allowed while half-open.
+	Probes int
+}
+
+type circuitBreaker struct {
+	mutex    sync.Mutex
+	config   CircuitBreakerConfig
+	state    CircuitState
+	failures []time.Time
+	openedAt time.Time
+	probes   int
+}
+
+func newCircuitBreaker(config CircuitBreakerConfig) *circuitBreaker {
+	if config.Threshold <= 0 {
+		config.Threshold = DefaultCircuitThreshold
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultCircuitWindow
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = DefaultCircuitOpenTimeout
+	}
+	if config.Probes <= 0 {
+		config.Probes = 1
+	}
+	return &circuitBreaker{config: config, state: CircuitClosed}
+}
+
+// allow reports whether a request may be sent, and the new state if the
+// breaker moved to half-open.
+func (cb *circuitBreaker) allow() (bool, CircuitState, bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	changed := false
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.config.OpenTimeout {
+		cb.state = CircuitHalfOpen
+		cb.probes = 0
+		changed = true
+	}
+	switch cb.state {
+	case CircuitOpen:
+		return false, cb.state, changed
+	case CircuitHalfOpen:
+		if cb.probes >= cb.config.Probes {
+			return false, cb.state, changed
+		}
+		cb.probes++
+	}
+	return true, cb.state, changed
+}
+
+// record counts the outcome of a request, and returns the new state if it changed.
+func (cb *circuitBreaker) record(failed bool) (CircuitState, bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	now := time.Now()
+	switch cb.state {
+	case CircuitHalfOpen:
+		if failed {
+			cb.trip(now)
+		} else {
+			cb.state = CircuitClosed
+			cb.failures = nil
+		}
+		return cb.state, true
+	case CircuitClosed:
+		if !failed {
+			return cb.state, false
+		}
+		cb.failures = append(cb.failures, now)
+		for len(cb.failures) > 0 && now.Sub(cb.failures[0]) > cb.config.Window {
+			cb.failures = cb.failures[1:]
+		}
+		if len(cb.failures) >= cb.config.Threshold {
+			cb.trip(now)
+			return cb.state, true
+		}
+	}
+	return cb.state, false
+}
+
+func (cb *circuitBreaker) trip(now time.Time) {
+	cb.state = CircuitOpen
+	cb.openedAt = now
+	cb.failures = nil
+}
+
+func (cb *circuitBreaker) current() CircuitState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.state
+}
+
+// release frees the probe of a request whose outcome is not counted.
+func (cb *circuitBreaker) release() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.state == CircuitHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+// isCircuitFailure reports whether err counts as a failure of the channel,
+// ok is false if it says nothing about the channel.
+func isCircuitFailure(err *Error) (failed bool, ok bool) {
+	if err.Code == TimeoutCode {
+		return true, true
+	}
+	if err.local {
+		return false, false
+	}
+	return err.Code >= 500, true
+}
+
+// SetCircuitBreaker enables a circuit breaker on the requestor, state
+// changes are emitted as CircuitEvent.
+func (req *Requestor) SetCircuitBreaker(config CircuitBreakerConfig) {
+	req.mutex.Lock()
+	defer req.mutex.Unlock()
+	req.breaker = newCircuitBreaker(config)
+}
+
+// CircuitState returns the state of the circuit breaker, CircuitClosed if disabled.
+func (req *Requestor) CircuitState() CircuitState {
+	req.mutex.Lock()
+	cb := req.breaker
+	req.mutex.Unlock()
+	if cb == nil {
+		return CircuitClosed
+	}
+	return cb.current()
+}
+
+// guard wraps the callbacks of a request with the circuit breaker, it
+// returns false if the request must fail fast.
+func (req *Requestor) guard(success AcceptFunc, reject func(err *Error)) (AcceptFunc, func(err *Error), bool) {
+	req.mutex.Lock()
+	cb := req.breaker
+	req.mutex.Unlock()
+	if cb == nil {
+		return success, reject, true
+	}
+	allowed, state, changed := cb.allow()
+	if changed {
+		req.emit(CircuitEvent{State: state})
+	}
+	if !allowed {
+		return success, reject, false
+	}
+	accept := func(data RawMessage) {
+		if state, changed := cb.record(false); changed {
+			req.emit(CircuitEvent{State: state})
+		}
+		success(data)
+	}
+	fail := func(err *Error) {
+		failed, ok := isCircuitFailure(err)
+		if !ok {
+			cb.release()
+			reject(err)
+			return
+		}
+		if state, changed := cb.record(failed); changed {
+			req.emit(CircuitEvent{State: state})
+		}
+		reject(err)
+	}
+	return accept, fail, true
+}
@@ -0,0 +1,61 @@
+package nprotoo
+
+import "testing"
+
+func TestCircuitFailures(t *testing.T) {
+	for _, c := range []struct {
+		err    *Error
+		failed bool
+		ok     bool
+	}{
+		{localErrorf(TimeoutCode, "timeout"), true, true},
+		{NewError(503, "Unavailable"), true, true},
+		{NewError(TransportClosedCode, "Bad gateway"), true, true},
+		{NewError(NotFoundCode, "Not found"), false, true},
+		{localErrorf(TransportClosedCode, "disconnected"), false, false},
+		{ErrTransportClosed.Wrap(nil), false, false},
+		{ErrCancelled, false, false},
+	} {
+		failed, ok := isCircuitFailure(c.err)
+		if failed != c.failed || ok != c.ok {
+			t.Errorf("isCircuitFailure(%d %s) = %v %v", c.err.Code, c.err.Reason, failed, ok)
+		}
+	}
+}
+
+func TestCircuitReleaseProbe(t *testing.T) {
+	cb := newCircuitBreaker(CircuitBreakerConfig{Threshold: 1})
+	cb.record(true)
+	cb.openedAt = cb.openedAt.Add(-DefaultCircuitOpenTimeout)
+	if allowed, state, _ := cb.allow(); !allowed || state != CircuitHalfOpen {
+		t.Fatalf("probe: got %v %s", allowed, state)
+	}
+	if allowed, _, _ := cb.allow(); allowed {
+		t.Fatalf("second probe allowed")
+	}
+	// A probe failing locally frees its slot without closing the circuit.
+	cb.release()
+	if cb.current() != CircuitHalfOpen {
+		t.Fatalf("state %s after release", cb.current())
+	}
+	if allowed, _, _ := cb.allow(); !allowed {
+		t.Fatalf("probe not allowed after release")
+	}
+}
+
+func TestCircuitIgnoresMarshalErrors(t *testing.T) {
+	np := NewNatsProtooWithTransport(NewLoopbackTransport())
+	defer np.Close()
+	req := np.NewRequestor("svc")
+	req.SetCircuitBreaker(CircuitBreakerConfig{Threshold: 1})
+	req.breaker.record(true)
+	req.breaker.openedAt = req.breaker.openedAt.Add(-DefaultCircuitOpenTimeout)
+
+	_, err := req.SyncRequest("join", make(chan int))
+	if err == nil || err.Code != BadRequestCode {
+		t.Fatalf("got %v, want bad request", err)
+	}
+	if state := req.CircuitState(); state != CircuitOpen {
+		t.Fatalf("marshal error moved the circuit to %s", state)
+	}
+}
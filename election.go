@@ -0,0 +1,388 @@
+package nprotoo
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
+	nats "github.com/nats-io/nats.go"
+)
+
+const (
+	// DefaultElectionBucket is the JetStream key-value bucket of elections.
+	DefaultElectionBucket = "NPROTOO_ELECTION"
+	// DefaultElectionTTL is how long a leader keeps leadership without
+	// renewing it.
+	DefaultElectionTTL = 10 * time.Second
+
+	// A leader steps down a tenth of the TTL before its entry may expire,
+	// leaving room for clock drift and late ticks.
+	electionMarginDivisor = 10
+)
+
+// ElectionConfig .
+type ElectionConfig struct {
+	// Bucket defaults to DefaultElectionBucket. The TTL of an existing
+	// bucket takes precedence over TTL.
+	Bucket string
+	TTL    time.Duration
+	// ID of the candidate, defaults to the node ID.
+	ID string
+}
+
+// LeaderElection elects one leader among the candidates of an election,
+// leadership is held by a JetStream key-value entry renewed every third
+// of the bucket TTL. It requires a NATS transport with JetStream.
+// Leadership also expires locally a tenth of the TTL before the entry may,
+// so that a leader cut off from JetStream steps down before another
+// candidate can take over.
+type LeaderElection struct {
+	np       *NatsProtoo
+	name     string
+	id       string
+	kv       nats.KeyValue
+	ttl      time.Duration
+	watcher  nats.KeyWatcher
+	mutex    sync.Mutex
+	leader   bool
+	leaderID string
+	revision uint64
+	token    uint64
+	renewed  time.Time
+	expiry   *time.Timer
+	resigned time.Time
+	nextID   uint64
+	elected  map[uint64]func(token uint64)
+	demoted  map[uint64]func()
+	stop     chan struct{}
+	done     chan struct{}
+	closed   bool
+}
+
+// NewLeaderElection joins the election name as a candidate, the first
+// campaign runs before it returns.
+func (np *NatsProtoo) NewLeaderElection(name string, config ElectionConfig) (*LeaderElection, error) {
+	if config.Bucket == _EMPTY_ {
+		config.Bucket = DefaultElectionBucket
+	}
+	if config.TTL <= 0 {
+		config.TTL = DefaultElectionTTL
+	}
+	if config.ID == _EMPTY_ {
+		config.ID = np.nodeID
+	}
+	js, err := np.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.KeyValue(config.Bucket)
+	if err == nats.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  config.Bucket,
+			TTL:     config.TTL,
+			History: 1,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	ttl := config.TTL
+	if status, err := kv.Status(); err == nil && status.TTL() > 0 {
+		ttl = status.TTL()
+	}
+	// Bound the key-value calls by the margin of the lease, a renewal
+	// blocking for the default API timeout could outlive it.
+	bounded, err := np.conn().JetStream(nats.MaxWait(ttl / electionMarginDivisor))
+	if err != nil {
+		return nil, err
+	}
+	if kv, err = bounded.KeyValue(config.Bucket); err != nil {
+		return nil, err
+	}
+	le := &LeaderElection{
+		np:      np,
+		name:    name,
+		id:      config.ID,
+		kv:      kv,
+		ttl:     ttl,
+		elected: make(map[uint64]func(uint64)),
+		demoted: make(map[uint64]func()),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if le.watcher, err = kv.Watch(name); err != nil {
+		logger.Warnf("Watch election %s %v, campaign every %v only", name, err, ttl/3)
+	}
+	le.campaign()
+	go le.run()
+	return le, nil
+}
+
+func (le *LeaderElection) run() {
+	defer close(le.done)
+	ticker := time.NewTicker(le.ttl / 3)
+	defer ticker.Stop()
+	var updates <-chan nats.KeyValueEntry
+	if le.watcher != nil {
+		updates = le.watcher.Updates()
+	}
+	for {
+		select {
+		case <-le.stop:
+			return
+		case <-ticker.C:
+			le.campaign()
+		case entry, ok := <-updates:
+			if !ok {
+				updates = nil
+				continue
+			}
+			if entry != nil && le.vacated(entry) {
+				le.campaign()
+			}
+		}
+	}
+}
+
+// vacated records the leader of entry and reports whether leadership is free.
+func (le *LeaderElection) vacated(entry nats.KeyValueEntry) bool {
+	free := entry.Operation() != nats.KeyValuePut || len(entry.Value()) == 0
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	if free {
+		le.leaderID = _EMPTY_
+	} else {
+		le.leaderID = string(entry.Value())
+	}
+	return free && !le.leader
+}
+
+// campaign renews leadership, or claims it if it is free.
+func (le *LeaderElection) campaign() {
+	le.mutex.Lock()
+	leader, revision, renewed, resigned := le.leader, le.revision, le.renewed, le.resigned
+	le.mutex.Unlock()
+
+	if leader {
+		next, err := le.kv.Update(le.name, []byte(le.id), revision)
+		if err == nil {
+			le.mutex.Lock()
+			expired := !le.leader
+			if !expired {
+				le.revision, le.renewed = next, time.Now()
+				le.expiry.Reset(le.lease())
+			}
+			le.mutex.Unlock()
+			if expired {
+				// The term ended while renewing, free the entry again.
+				if _, err := le.kv.Update(le.name, []byte{}, next); err != nil {
+					logger.Debugf("Free leadership of %s %v", le.name, err)
+				}
+			}
+			return
+		}
+		// Another candidate may take over once the entry expires, step
+		// down if it could expire before the next renewal.
+		if isWrongLastSequence(err) || time.Since(renewed)+le.ttl/3 >= le.lease() {
+			logger.Warnf("Lost leadership of %s: %v", le.name, err)
+			le.demote()
+			return
+		}
+		logger.Debugf("Renew leadership of %s failed: %v", le.name, err)
+		return
+	}
+
+	if time.Since(resigned) < le.ttl/3 {
+		// Let the other candidates take over first.
+		return
+	}
+	var next uint64
+	entry, err := le.kv.Get(le.name)
+	switch {
+	case err == nats.ErrKeyNotFound:
+		next, err = le.kv.Create(le.name, []byte(le.id))
+	case err != nil:
+		logger.Debugf("Campaign %s failed: %v", le.name, err)
+		return
+	case len(entry.Value()) == 0:
+		next, err = le.kv.Update(le.name, []byte(le.id), entry.Revision())
+	default:
+		le.mutex.Lock()
+		le.leaderID = string(entry.Value())
+		le.mutex.Unlock()
+		return
+	}
+	if err != nil {
+		logger.Debugf("Campaign %s lost: %v", le.name, err)
+		return
+	}
+	le.elect(next)
+}
+
+// lease is how long leadership lasts locally after a renewal.
+func (le *LeaderElection) lease() time.Duration {
+	return le.ttl - le.ttl/electionMarginDivisor
+}
+
+// expire demotes the leader once its lease ran out without renewal.
+func (le *LeaderElection) expire() {
+	le.mutex.Lock()
+	expired := le.leader && time.Since(le.renewed) >= le.lease()
+	le.mutex.Unlock()
+	if expired {
+		logger.Warnf("Leadership of %s expired", le.name)
+		le.demote()
+	}
+}
+
+// leading reports whether the lease of the leader holds, the caller must
+// hold le.mutex.
+func (le *LeaderElection) leading() bool {
+	return le.leader && time.Since(le.renewed) < le.lease()
+}
+
+// isWrongLastSequence reports whether an update failed because the entry
+// changed, the JetStream API error is only available as text.
+func isWrongLastSequence(err error) bool {
+	return strings.Contains(err.Error(), "wrong last sequence")
+}
+
+func (le *LeaderElection) elect(revision uint64) {
+	le.mutex.Lock()
+	if le.closed {
+		le.mutex.Unlock()
+		return
+	}
+	le.leader, le.leaderID = true, le.id
+	le.revision, le.token, le.renewed = revision, revision, time.Now()
+	if le.expiry == nil {
+		le.expiry = time.AfterFunc(le.lease(), le.expire)
+	} else {
+		le.expiry.Reset(le.lease())
+	}
+	callbacks := make([]func(uint64), 0, len(le.elected))
+	for _, fn := range le.elected {
+		callbacks = append(callbacks, fn)
+	}
+	le.mutex.Unlock()
+	logger.Infof("Elected leader of %s, token %d", le.name, revision)
+	for _, fn := range callbacks {
+		fn(revision)
+	}
+}
+
+func (le *LeaderElection) demote() {
+	le.mutex.Lock()
+	if !le.leader {
+		le.mutex.Unlock()
+		return
+	}
+	le.leader, le.token = false, 0
+	le.expiry.Stop()
+	callbacks := make([]func(), 0, len(le.demoted))
+	for _, fn := range le.demoted {
+		callbacks = append(callbacks, fn)
+	}
+	le.mutex.Unlock()
+	logger.Infof("Demoted from leader of %s", le.name)
+	for _, fn := range callbacks {
+		fn()
+	}
+}
+
+// IsLeader .
+func (le *LeaderElection) IsLeader() bool {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	return le.leading()
+}
+
+// Leader returns the ID of the last known leader, empty if there is none.
+func (le *LeaderElection) Leader() string {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	return le.leaderID
+}
+
+// Token returns the fencing token of the current term, zero if the
+// candidate is not the leader. Tokens grow with every term, so resources
+// can reject writes carrying a token older than the newest seen.
+func (le *LeaderElection) Token() uint64 {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	if !le.leading() {
+		return 0
+	}
+	return le.token
+}
+
+// OnElected registers fn for the start of a term with its fencing token,
+// it runs right away if the candidate is the leader already. The returned
+// func removes it.
+func (le *LeaderElection) OnElected(fn func(token uint64)) (remove func()) {
+	le.mutex.Lock()
+	le.nextID++
+	id := le.nextID
+	le.elected[id] = fn
+	leader, token := le.leading(), le.token
+	le.mutex.Unlock()
+	if leader {
+		fn(token)
+	}
+	return func() {
+		le.mutex.Lock()
+		defer le.mutex.Unlock()
+		delete(le.elected, id)
+	}
+}
+
+// OnDemoted registers fn for the end of a term, the returned func removes it.
+func (le *LeaderElection) OnDemoted(fn func()) (remove func()) {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	le.nextID++
+	id := le.nextID
+	le.demoted[id] = fn
+	return func() {
+		le.mutex.Lock()
+		defer le.mutex.Unlock()
+		delete(le.demoted, id)
+	}
+}
+
+// Resign ends the term of the leader and frees leadership for the other
+// candidates, it may be elected again by a campaign a third of the TTL
+// later.
+func (le *LeaderElection) Resign() {
+	le.mutex.Lock()
+	leader, revision := le.leader, le.revision
+	if leader {
+		le.resigned = time.Now()
+	}
+	le.mutex.Unlock()
+	if !leader {
+		return
+	}
+	le.demote()
+	if _, err := le.kv.Update(le.name, []byte{}, revision); err != nil {
+		logger.Warnf("Resign leadership of %s %v", le.name, err)
+	}
+}
+
+// Close resigns and leaves the election.
+func (le *LeaderElection) Close() {
+	le.mutex.Lock()
+	if le.closed {
+		le.mutex.Unlock()
+		return
+	}
+	le.closed = true
+	le.mutex.Unlock()
+	close(le.stop)
+	<-le.done
+	le.Resign()
+	if le.watcher != nil {
+		le.watcher.Stop()
+	}
+}
@@ -0,0 +1,107 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Error codes used by the library, listeners are free to reject with others.
+const (
+	// BadRequestCode .
+	BadRequestCode = 400
+	// NotFoundCode .
+	NotFoundCode = 404
+	// CancelledCode is used when the requestor abandoned the request.
+	CancelledCode = 499
+	// TimeoutCode is used when no response arrived within the request timeout.
+	TimeoutCode = 480
+	// NoResponderCode is used when no listener is registered for a channel.
+	NoResponderCode = 500
+	// TransportClosedCode is used when the NATS connection is closed.
+	TransportClosedCode = 502
+)
+
+// Sentinel errors, compare with errors.Is which matches on Code. The
+// sentinels of errors raised locally, from ErrCancelled on, only match
+// errors raised by this side, not rejects of a listener with their code.
+var (
+	ErrBadRequest      = &Error{Code: BadRequestCode, Reason: "Bad request"}
+	ErrNotFound        = &Error{Code: NotFoundCode, Reason: "Not found"}
+	ErrRateLimited     = &Error{Code: RateLimitedCode, Reason: "Too many requests"}
+	ErrCancelled       = &Error{Code: CancelledCode, Reason: "Request cancelled", local: true}
+	ErrTimeout         = &Error{Code: TimeoutCode, Reason: "Request timeout", local: true}
+	ErrNoResponder     = &Error{Code: NoResponderCode, Reason: "No responder", local: true}
+	ErrTransportClosed = &Error{Code: TransportClosedCode, Reason: "Transport closed", local: true}
+	ErrCircuitOpen     = &Error{Code: CircuitOpenCode, Reason: "Circuit open", local: true}
+)
+
+// Error .
+type Error struct {
+	Code   int
+	Reason string
+	// Data is the optional structured data of an error response.
+	Data RawMessage
+	// RetryAfter is the wait hinted by rate limited requests, zero if none.
+	RetryAfter time.Duration
+	cause      error
+	// local is set on errors raised by this library rather than by a
+	// listener, on this side or, for no responders, on the listener side.
+	local bool
+}
+
+// NewError .
+func NewError(code int, reason string) *Error {
+	return &Error{Code: code, Reason: reason}
+}
+
+// Errorf .
+func Errorf(code int, format string, v ...interface{}) *Error {
+	return &Error{Code: code, Reason: fmt.Sprintf(format, v...)}
+}
+
+// localErrorf is Errorf for errors raised by this side.
+func localErrorf(code int, format string, v ...interface{}) *Error {
+	err := Errorf(code, format, v...)
+	err.local = true
+	return err
+}
+
+// WithData returns a copy of e carrying data as its structured data.
+func (e *Error) WithData(data interface{}) *Error {
+	err := *e
+	if raw, ok := data.(RawMessage); ok {
+		err.Data = raw
+		return &err
+	}
+	raw, marshalErr := json.Marshal(data)
+	if marshalErr != nil {
+		err.cause = marshalErr
+		return &err
+	}
+	err.Data = raw
+	return &err
+}
+
+// Wrap returns a copy of e with cause as its underlying error.
+func (e *Error) Wrap(cause error) *Error {
+	err := *e
+	err.cause = cause
+	return &err
+}
+
+func (e *Error) Error() string {
+	return e.Reason
+}
+
+// Is reports whether target is an *Error with the same Code, a target
+// raised locally only matches errors raised locally.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code && (!t.local || e.local)
+}
+
+// Unwrap .
+func (e *Error) Unwrap() error {
+	return e.cause
+}
@@ -0,0 +1,287 @@
+package nprotoo
+
+import (
+	"sync"
+
+	"github.com/chuckpreslar/emission"
+	"github.com/cloudwebrtc/nats-protoo/logger"
+)
+
+const (
+	eventStreamSize = 64
+)
+
+// Event is implemented by CloseEvent, ErrorEvent, DisconnectedEvent,
+// ReconnectedEvent, DiscoveredServersEvent, LameDuckEvent,
+// SlowConsumerEvent, CircuitEvent, NodeUpEvent and NodeDownEvent.
+type Event interface {
+	// legacy returns the name and arguments of the deprecated string event.
+	legacy() (string, []interface{})
+}
+
+// CloseEvent is emitted when the NATS connection is closed for good.
+type CloseEvent struct {
+	Code   int
+	Reason string
+}
+
+// ErrorEvent .
+type ErrorEvent struct {
+	Code   int
+	Reason string
+	// Subject of the subscription the asynchronous error relates to, if any.
+	Subject string
+	Err     error
+}
+
+// DisconnectedEvent is emitted when the NATS connection is lost, reconnects
+// are attempted afterwards.
+type DisconnectedEvent struct {
+	Err error
+}
+
+// ReconnectedEvent .
+type ReconnectedEvent struct {
+	URL string
+}
+
+// DiscoveredServersEvent is emitted when the cluster announces new servers.
+type DiscoveredServersEvent struct {
+	Servers []string
+}
+
+// LameDuckEvent is emitted when the connected server enters lame duck mode
+// and will shortly close client connections.
+type LameDuckEvent struct {
+	URL string
+}
+
+// SlowConsumerEvent is emitted when messages of a subscription are dropped
+// because its handler cannot keep up.
+type SlowConsumerEvent struct {
+	Subject string
+	Pending int
+}
+
+// CircuitEvent is emitted by a Requestor when its circuit breaker changes state.
+type CircuitEvent struct {
+	State CircuitState
+}
+
+// NodeUpEvent is emitted when presence sees the first heartbeat of a node.
+type NodeUpEvent struct {
+	Node NodeInfo
+}
+
+// NodeDownEvent is emitted when a node left or its heartbeats expired.
+type NodeDownEvent struct {
+	Node   NodeInfo
+	Reason string
+}
+
+func (e CloseEvent) legacy() (string, []interface{}) {
+	return "close", []interface{}{e.Code, e.Reason}
+}
+
+func (e ErrorEvent) legacy() (string, []interface{}) {
+	return "error", []interface{}{e.Code, e.Reason}
+}
+
+func (e DisconnectedEvent) legacy() (string, []interface{}) {
+	reason := _EMPTY_
+	if e.Err != nil {
+		reason = e.Err.Error()
+	}
+	return "disconnected", []interface{}{reason}
+}
+
+func (e ReconnectedEvent) legacy() (string, []interface{}) {
+	return "reconnected", []interface{}{e.URL}
+}
+
+func (e DiscoveredServersEvent) legacy() (string, []interface{}) {
+	return "discoveredServers", []interface{}{e.Servers}
+}
+
+func (e LameDuckEvent) legacy() (string, []interface{}) {
+	return "lameDuck", []interface{}{e.URL}
+}
+
+func (e SlowConsumerEvent) legacy() (string, []interface{}) {
+	return "slowConsumer", []interface{}{e.Subject, e.Pending}
+}
+
+func (e CircuitEvent) legacy() (string, []interface{}) {
+	return "circuit", []interface{}{e.State}
+}
+
+func (e NodeUpEvent) legacy() (string, []interface{}) {
+	return "nodeUp", []interface{}{e.Node}
+}
+
+func (e NodeDownEvent) legacy() (string, []interface{}) {
+	return "nodeDown", []interface{}{e.Node, e.Reason}
+}
+
+type eventListener struct {
+	id uint64
+	fn func(Event)
+}
+
+// eventHub dispatches typed events to registered callbacks and streams, and
+// mirrors them on the deprecated string-keyed emitter.
+type eventHub struct {
+	mutex     sync.Mutex
+	emitter   *emission.Emitter
+	nextID    uint64
+	listeners []eventListener
+	streams   []chan Event
+	closed    bool
+}
+
+func newEventHub(emitter *emission.Emitter) *eventHub {
+	return &eventHub{emitter: emitter}
+}
+
+func (h *eventHub) subscribe(fn func(Event)) (remove func()) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.nextID++
+	id := h.nextID
+	h.listeners = append(h.listeners, eventListener{id: id, fn: fn})
+	return func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		for i, l := range h.listeners {
+			if l.id == id {
+				h.listeners = append(h.listeners[:i:i], h.listeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// OnClose registers fn for CloseEvent, the returned func removes it.
+func (h *eventHub) OnClose(fn func(CloseEvent)) (remove func()) {
+	return h.subscribe(func(e Event) {
+		if ev, ok := e.(CloseEvent); ok {
+			fn(ev)
+		}
+	})
+}
+
+// OnError registers fn for ErrorEvent, the returned func removes it.
+func (h *eventHub) OnError(fn func(ErrorEvent)) (remove func()) {
+	return h.subscribe(func(e Event) {
+		if ev, ok := e.(ErrorEvent); ok {
+			fn(ev)
+		}
+	})
+}
+
+// OnDisconnected registers fn for DisconnectedEvent, the returned func removes it.
+func (h *eventHub) OnDisconnected(fn func(DisconnectedEvent)) (remove func()) {
+	return h.subscribe(func(e Event) {
+		if ev, ok := e.(DisconnectedEvent); ok {
+			fn(ev)
+		}
+	})
+}
+
+// OnReconnected registers fn for ReconnectedEvent, the returned func removes it.
+func (h *eventHub) OnReconnected(fn func(ReconnectedEvent)) (remove func()) {
+	return h.subscribe(func(e Event) {
+		if ev, ok := e.(ReconnectedEvent); ok {
+			fn(ev)
+		}
+	})
+}
+
+// OnDiscoveredServers registers fn for DiscoveredServersEvent, the returned func removes it.
+func (h *eventHub) OnDiscoveredServers(fn func(DiscoveredServersEvent)) (remove func()) {
+	return h.subscribe(func(e Event) {
+		if ev, ok := e.(DiscoveredServersEvent); ok {
+			fn(ev)
+		}
+	})
+}
+
+// OnLameDuck registers fn for LameDuckEvent, the returned func removes it.
+func (h *eventHub) OnLameDuck(fn func(LameDuckEvent)) (remove func()) {
+	return h.subscribe(func(e Event) {
+		if ev, ok := e.(LameDuckEvent); ok {
+			fn(ev)
+		}
+	})
+}
+
+// OnSlowConsumer registers fn for SlowConsumerEvent, the returned func removes it.
+func (h *eventHub) OnSlowConsumer(fn func(SlowConsumerEvent)) (remove func()) {
+	return h.subscribe(func(e Event) {
+		if ev, ok := e.(SlowConsumerEvent); ok {
+			fn(ev)
+		}
+	})
+}
+
+// OnNodeUp registers fn for NodeUpEvent, the returned func removes it.
+func (h *eventHub) OnNodeUp(fn func(NodeUpEvent)) (remove func()) {
+	return h.subscribe(func(e Event) {
+		if ev, ok := e.(NodeUpEvent); ok {
+			fn(ev)
+		}
+	})
+}
+
+// OnNodeDown registers fn for NodeDownEvent, the returned func removes it.
+func (h *eventHub) OnNodeDown(fn func(NodeDownEvent)) (remove func()) {
+	return h.subscribe(func(e Event) {
+		if ev, ok := e.(NodeDownEvent); ok {
+			fn(ev)
+		}
+	})
+}
+
+// Events returns a stream of all events, it is closed after the CloseEvent.
+// Events are dropped when the reader falls behind.
+func (h *eventHub) Events() <-chan Event {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	stream := make(chan Event, eventStreamSize)
+	if h.closed {
+		close(stream)
+		return stream
+	}
+	h.streams = append(h.streams, stream)
+	return stream
+}
+
+func (h *eventHub) emit(e Event) {
+	h.mutex.Lock()
+	listeners := make([]eventListener, len(h.listeners))
+	copy(listeners, h.listeners)
+	_, closing := e.(CloseEvent)
+	for _, stream := range h.streams {
+		select {
+		case stream <- e:
+		default:
+			logger.Warnf("Event stream full, drop %T", e)
+		}
+		if closing {
+			close(stream)
+		}
+	}
+	if closing {
+		h.streams = nil
+		h.closed = true
+	}
+	h.mutex.Unlock()
+
+	for _, l := range listeners {
+		l.fn(e)
+	}
+	if h.emitter != nil {
+		name, args := e.legacy()
+		h.emitter.Emit(name, args...)
+	}
+}
@@ -0,0 +1,310 @@
+package nprotoo
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
+	nats "github.com/nats-io/nats.go"
+)
+
+const (
+	// DefaultIdempotencyCacheSize .
+	DefaultIdempotencyCacheSize = 4096
+)
+
+// IdempotencyStore keeps responses of handled requests so that duplicates
+// can be answered without running the request listener again.
+type IdempotencyStore interface {
+	// Begin claims key for processing. When the key was already claimed,
+	// duplicate is true and response holds the cached response, or nil if
+	// the first request is still being processed.
+	Begin(key string, window time.Duration) (response []byte, duplicate bool, err error)
+	// Finish stores the response for key for the given window.
+	Finish(key string, response []byte, window time.Duration) error
+	// Release drops the claim of Begin on key without a response, e.g.
+	// when the request was cancelled, so that it can be claimed again.
+	Release(key string) error
+}
+
+type lruEntry struct {
+	key      string
+	response []byte
+	expires  time.Time
+}
+
+// MemoryIdempotencyStore is an in-memory LRU IdempotencyStore.
+type MemoryIdempotencyStore struct {
+	mutex    sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+}
+
+// NewMemoryIdempotencyStore .
+func NewMemoryIdempotencyStore(capacity int) *MemoryIdempotencyStore {
+	if capacity <= 0 {
+		capacity = DefaultIdempotencyCacheSize
+	}
+	return &MemoryIdempotencyStore{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Begin .
+func (s *MemoryIdempotencyStore) Begin(key string, window time.Duration) ([]byte, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	if elem, found := s.items[key]; found {
+		entry := elem.Value.(*lruEntry)
+		if now.Before(entry.expires) {
+			s.order.MoveToFront(elem)
+			return entry.response, true, nil
+		}
+		s.order.Remove(elem)
+		delete(s.items, key)
+	}
+	s.items[key] = s.order.PushFront(&lruEntry{key: key, expires: now.Add(window)})
+	s.evict()
+	return nil, false, nil
+}
+
+// evict drops the least recently used entries over capacity, the caller
+// must hold s.mutex.
+func (s *MemoryIdempotencyStore) evict() {
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Finish .
+func (s *MemoryIdempotencyStore) Finish(key string, response []byte, window time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := &lruEntry{key: key, response: response, expires: time.Now().Add(window)}
+	if elem, found := s.items[key]; found {
+		elem.Value = entry
+		s.order.MoveToFront(elem)
+		return nil
+	}
+	s.items[key] = s.order.PushFront(entry)
+	s.evict()
+	return nil
+}
+
+// Release .
+func (s *MemoryIdempotencyStore) Release(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if elem, found := s.items[key]; found {
+		s.order.Remove(elem)
+		delete(s.items, key)
+	}
+	return nil
+}
+
+// KVIdempotencyStore is an IdempotencyStore backed by a JetStream key-value
+// bucket, so that duplicates are detected across listener replicas.
+// Entries expire with the TTL of the bucket, the window is not used.
+type KVIdempotencyStore struct {
+	kv nats.KeyValue
+}
+
+// NewKVIdempotencyStore .
+func NewKVIdempotencyStore(kv nats.KeyValue) *KVIdempotencyStore {
+	return &KVIdempotencyStore{kv: kv}
+}
+
+// Begin .
+func (s *KVIdempotencyStore) Begin(key string, window time.Duration) ([]byte, bool, error) {
+	return s.begin(kvKey(key))
+}
+
+func (s *KVIdempotencyStore) begin(key string) ([]byte, bool, error) {
+	if _, err := s.kv.Create(key, []byte{}); err == nil {
+		return nil, false, nil
+	}
+	entry, err := s.kv.Get(key)
+	if err == nats.ErrKeyNotFound {
+		// Expired between Create and Get, claim it again.
+		return s.begin(key)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(entry.Value()) == 0 {
+		return nil, true, nil
+	}
+	return entry.Value(), true, nil
+}
+
+// Finish .
+func (s *KVIdempotencyStore) Finish(key string, response []byte, window time.Duration) error {
+	_, err := s.kv.Put(kvKey(key), response)
+	return err
+}
+
+// Release .
+func (s *KVIdempotencyStore) Release(key string) error {
+	return s.kv.Delete(kvKey(key))
+}
+
+func kvKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetIdempotencyWindow enables request deduplication on the listener, the
+// response of a request is replayed for duplicates received within d.
+// Zero disables deduplication.
+func (np *NatsProtoo) SetIdempotencyWindow(d time.Duration) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	np.idempotencyWindow = d
+	if d > 0 && np.idempotencyStore == nil {
+		np.idempotencyStore = NewMemoryIdempotencyStore(DefaultIdempotencyCacheSize)
+	}
+}
+
+// SetIdempotencyStore replaces the default in-memory store.
+func (np *NatsProtoo) SetIdempotencyStore(store IdempotencyStore) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	np.idempotencyStore = store
+}
+
+func idempotencyKey(msg Request, subj string, reply string) string {
+	if msg.IdempotencyKey != _EMPTY_ {
+		return subj + ":" + msg.IdempotencyKey
+	}
+	return fmt.Sprintf("%s:%s:%d", subj, reply, msg.ID)
+}
+
+// beginIdempotent reports whether the request should be handled. Duplicates
+// are answered from the store, or parked until the first request completes.
+func (np *NatsProtoo) beginIdempotent(key string, msg Request, reply string) bool {
+	np.mutex.Lock()
+	store, window := np.idempotencyStore, np.idempotencyWindow
+	np.mutex.Unlock()
+	if store == nil || window <= 0 {
+		return true
+	}
+	cached, duplicate, err := store.Begin(key, window)
+	if err != nil {
+		logger.Warnf("Idempotency store error for [%s] %v", msg.Method, err)
+		return true
+	}
+	if !duplicate {
+		np.mutex.Lock()
+		now := time.Now()
+		if now.Sub(np.idempotentSwept) >= window {
+			np.idempotentSwept = now
+			np.expireIdempotent(now)
+		}
+		np.idempotentPending[key] = &pendingIdempotent{expires: now.Add(window)}
+		np.mutex.Unlock()
+		return true
+	}
+	if cached != nil {
+		logger.Debugf("Replay response for duplicate request [%s] id:%d", msg.Method, msg.ID)
+		np.Reply(replayResponse(cached, msg.ID), reply)
+		return false
+	}
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	if pending, found := np.idempotentPending[key]; found {
+		logger.Debugf("Hold duplicate request [%s] id:%d", msg.Method, msg.ID)
+		pending.waiting = append(pending.waiting, pendingReply{id: msg.ID, reply: reply})
+	} else {
+		logger.Debugf("Drop duplicate request [%s] id:%d, in progress elsewhere", msg.Method, msg.ID)
+	}
+	return false
+}
+
+// finishIdempotent caches the response and answers held duplicates.
+func (np *NatsProtoo) finishIdempotent(key string, payload []byte) {
+	np.mutex.Lock()
+	store, window := np.idempotencyStore, np.idempotencyWindow
+	pending := np.idempotentPending[key]
+	delete(np.idempotentPending, key)
+	np.mutex.Unlock()
+	if store == nil {
+		return
+	}
+	if err := store.Finish(key, payload, window); err != nil {
+		logger.Warnf("Idempotency store error %v", err)
+	}
+	if pending == nil {
+		return
+	}
+	for _, w := range pending.waiting {
+		np.Reply(replayResponse(payload, w.id), w.reply)
+	}
+}
+
+// releaseIdempotent drops the claim of a request answered with nothing,
+// duplicates held for it are dropped and must be retried.
+func (np *NatsProtoo) releaseIdempotent(key string) {
+	np.mutex.Lock()
+	store, window := np.idempotencyStore, np.idempotencyWindow
+	pending := np.idempotentPending[key]
+	delete(np.idempotentPending, key)
+	np.mutex.Unlock()
+	if store == nil || window <= 0 {
+		return
+	}
+	if pending != nil && len(pending.waiting) > 0 {
+		logger.Debugf("Drop %d duplicates of cancelled request %s", len(pending.waiting), key)
+	}
+	if err := store.Release(key); err != nil {
+		logger.Warnf("Idempotency store error %v", err)
+	}
+}
+
+type pendingReply struct {
+	id    int
+	reply string
+}
+
+// pendingIdempotent is a request being handled with the duplicates held
+// until it completes, it is dropped with them after the window in case
+// the listener never answers.
+type pendingIdempotent struct {
+	expires time.Time
+	waiting []pendingReply
+}
+
+// expireIdempotent drops pending requests past their window, the caller
+// must hold np.mutex.
+func (np *NatsProtoo) expireIdempotent(now time.Time) {
+	for key, pending := range np.idempotentPending {
+		if now.After(pending.expires) {
+			logger.Debugf("Drop %d duplicates of unanswered request %s", len(pending.waiting), key)
+			delete(np.idempotentPending, key)
+		}
+	}
+}
+
+// replayResponse rewrites the id of a cached response for a duplicate.
+func replayResponse(payload []byte, id int) []byte {
+	var response Response
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return payload
+	}
+	response.ID = id
+	replayed, err := json.Marshal(response)
+	if err != nil {
+		return payload
+	}
+	return replayed
+}
@@ -0,0 +1,41 @@
+package nprotoo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryIdempotencyStoreCapacity(t *testing.T) {
+	s := NewMemoryIdempotencyStore(2)
+	for _, key := range []string{"a", "b", "c"} {
+		s.Finish(key, []byte(key), time.Minute)
+	}
+	if len(s.items) != 2 || s.order.Len() != 2 {
+		t.Fatalf("store holds %d entries, want 2", len(s.items))
+	}
+	if _, duplicate, _ := s.Begin("a", time.Minute); duplicate {
+		t.Fatalf("oldest entry not evicted")
+	}
+}
+
+func TestIdempotentPendingExpires(t *testing.T) {
+	np := NewNatsProtooWithTransport(NewLoopbackTransport())
+	defer np.Close()
+	np.SetIdempotencyWindow(10 * time.Millisecond)
+	var msg Request
+	msg.IdempotencyKey = "join-1"
+	if !np.beginIdempotent(idempotencyKey(msg, "svc", "r1"), msg, "r1") {
+		t.Fatalf("first request not handled")
+	}
+	if np.beginIdempotent(idempotencyKey(msg, "svc", "r2"), msg, "r2") {
+		t.Fatalf("duplicate handled")
+	}
+	time.Sleep(20 * time.Millisecond)
+	msg.IdempotencyKey = "join-2"
+	np.beginIdempotent(idempotencyKey(msg, "svc", "r3"), msg, "r3")
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	if _, found := np.idempotentPending["svc:join-1"]; found || len(np.idempotentPending) != 1 {
+		t.Fatalf("unanswered request not expired: %v", np.idempotentPending)
+	}
+}
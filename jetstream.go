@@ -0,0 +1,159 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
+	nats "github.com/nats-io/nats.go"
+)
+
+const (
+	// DurableStreamPrefix prefixes the JetStream stream of durable broadcast channels.
+	DurableStreamPrefix = "NPROTOO_"
+	// DefaultDurableMaxAge is how long notifications are retained by durable channels.
+	DefaultDurableMaxAge = time.Hour
+)
+
+// PubAck acknowledges a notification persisted by JetStream.
+type PubAck struct {
+	Stream    string
+	Sequence  uint64
+	Duplicate bool
+}
+
+// NewDurableBroadcaster returns a broadcaster persisting notifications in a
+// JetStream stream of the channel, the stream is created if missing.
+func (np *NatsProtoo) NewDurableBroadcaster(channel string) (*Broadcaster, error) {
+	if _, err := np.ensureStream(channel); err != nil {
+		return nil, err
+	}
+	bc := newBroadcaster(channel, np)
+	bc.durable = true
+	return bc, nil
+}
+
+// OnDurableBroadcast registers listener on the durable consumer named durable
+// of a channel, notifications are acked once listener returns, so those sent
+// while the consumer was away are delivered when it comes back.
+func (np *NatsProtoo) OnDurableBroadcast(channel string, durable string, listener BroadCastFunc) (*Subscription, error) {
+	stream, err := np.ensureStream(channel)
+	if err != nil {
+		return nil, err
+	}
+	js, err := np.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	// Create the consumer ourselves and bind to it, so that unsubscribing
+	// keeps the durable consumer and its position.
+	if _, err := js.ConsumerInfo(stream, durable); err == nats.ErrConsumerNotFound {
+		_, err = js.AddConsumer(stream, &nats.ConsumerConfig{
+			Durable:        durable,
+			DeliverSubject: nats.NewInbox(),
+			DeliverPolicy:  nats.DeliverNewPolicy,
+			AckPolicy:      nats.AckExplicitPolicy,
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	sub, err := js.Subscribe(channel, func(msg *nats.Msg) {
+		np.handleDurable(msg, channel, listener)
+	}, nats.Bind(stream, durable), nats.ManualAck())
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("OnDurableBroadcast: [channel:%s, durable:%s]", channel, durable)
+	return &Subscription{channel: channel, np: np, sub: sub}, nil
+}
+
+func (np *NatsProtoo) handleDurable(msg *nats.Msg, channel string, listener BroadCastFunc) {
+	var peerMsg PeerMsg
+	if err := json.Unmarshal(msg.Data, &peerMsg); err != nil || !peerMsg.Notification {
+		logger.Errorf("Drop durable message on %s %v", channel, err)
+		msg.Term()
+		return
+	}
+	data := peerMsg.ToNotification()
+	if meta, err := msg.Metadata(); err == nil {
+		data.StreamSeq = meta.Sequence.Stream
+	}
+	listener(data, channel)
+	if err := msg.Ack(); err != nil {
+		logger.Warnf("Ack durable notification on %s %v", channel, err)
+	}
+}
+
+func (np *NatsProtoo) publishDurable(channel string, payload []byte) (*PubAck, error) {
+	js, err := np.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	ack, err := js.Publish(channel, payload)
+	if err != nil {
+		return nil, ErrTransportClosed.Wrap(err)
+	}
+	return &PubAck{Stream: ack.Stream, Sequence: ack.Sequence, Duplicate: ack.Duplicate}, nil
+}
+
+func (np *NatsProtoo) jetStream() (nats.JetStreamContext, error) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	if np.js == nil {
+		nc := np.conn()
+		if nc == nil {
+			return nil, ErrNoJetStream
+		}
+		js, err := nc.JetStream()
+		if err != nil {
+			return nil, err
+		}
+		np.js = js
+	}
+	return np.js, nil
+}
+
+// ensureStream creates the stream of a durable channel and returns its name.
+func (np *NatsProtoo) ensureStream(channel string) (string, error) {
+	js, err := np.jetStream()
+	if err != nil {
+		return _EMPTY_, err
+	}
+	name := streamName(channel)
+	if _, err := js.StreamInfo(name); err == nil {
+		return name, nil
+	} else if err != nats.ErrStreamNotFound {
+		return _EMPTY_, err
+	}
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     name,
+		Subjects: []string{channel},
+		MaxAge:   DefaultDurableMaxAge,
+	})
+	if err != nil {
+		return _EMPTY_, err
+	}
+	logger.Infof("Created stream %s for durable channel %s", name, channel)
+	return name, nil
+}
+
+// streamName returns the stream of channel, characters streams may not be
+// named with are replaced and a hash of channel keeps names distinct, e.g.
+// for "a.b" and "a_b".
+func streamName(channel string) string {
+	h := fnv.New64a()
+	h.Write([]byte(channel))
+	return DurableStreamPrefix + strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '/', '\\':
+			return '_'
+		}
+		return r
+	}, channel) + "_" + strconv.FormatUint(h.Sum64(), 16)
+}
@@ -0,0 +1,211 @@
+package nprotoo
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// ErrLoopbackClosed .
+var ErrLoopbackClosed = errors.New("loopback: transport closed")
+
+// LoopbackBus routes messages between the loopback transports connected to
+// it in memory, for tests and single-process deployments.
+type LoopbackBus struct {
+	mutex  sync.Mutex
+	nextID uint64
+	subs   map[uint64]*loopbackSub
+}
+
+// NewLoopbackBus .
+func NewLoopbackBus() *LoopbackBus {
+	return &LoopbackBus{subs: make(map[uint64]*loopbackSub)}
+}
+
+// NewLoopbackTransport returns a transport connected to a new bus of its own.
+func NewLoopbackTransport() *LoopbackTransport {
+	return NewLoopbackBus().Transport()
+}
+
+// Transport connects a new loopback transport to the bus.
+func (bus *LoopbackBus) Transport() *LoopbackTransport {
+	return &LoopbackTransport{bus: bus, subs: make(map[uint64]*loopbackSub)}
+}
+
+func (bus *LoopbackBus) publish(msg *Msg) {
+	bus.mutex.Lock()
+	var targets []*loopbackSub
+	groups := make(map[string][]*loopbackSub)
+	for _, sub := range bus.subs {
+		if !subjectMatches(sub.subject, msg.Subject) {
+			continue
+		}
+		if sub.queue == _EMPTY_ {
+			targets = append(targets, sub)
+		} else {
+			groups[sub.queue] = append(groups[sub.queue], sub)
+		}
+	}
+	bus.mutex.Unlock()
+	for _, members := range groups {
+		targets = append(targets, members[rand.Intn(len(members))])
+	}
+	for _, sub := range targets {
+		sub.enqueue(msg)
+	}
+}
+
+// subjectMatches reports whether subject matches the pattern of a subscription.
+func subjectMatches(pattern string, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) {
+			return false
+		}
+		if token != "*" && token != subjectTokens[i] {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
+
+// LoopbackTransport is an in-memory Transport, see LoopbackBus.
+type LoopbackTransport struct {
+	mutex  sync.Mutex
+	bus    *LoopbackBus
+	subs   map[uint64]*loopbackSub
+	closed bool
+}
+
+// Publish .
+func (t *LoopbackTransport) Publish(subj string, reply string, data []byte) error {
+	t.mutex.Lock()
+	closed := t.closed
+	t.mutex.Unlock()
+	if closed {
+		return ErrLoopbackClosed
+	}
+	payload := make([]byte, len(data))
+	copy(payload, data)
+	t.bus.publish(&Msg{Subject: subj, Reply: reply, Data: payload})
+	return nil
+}
+
+// Subscribe .
+func (t *LoopbackTransport) Subscribe(subj string, handler MsgHandler) (TransportSubscription, error) {
+	return t.QueueSubscribe(subj, _EMPTY_, handler)
+}
+
+// QueueSubscribe .
+func (t *LoopbackTransport) QueueSubscribe(subj string, queue string, handler MsgHandler) (TransportSubscription, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return nil, ErrLoopbackClosed
+	}
+	t.bus.mutex.Lock()
+	t.bus.nextID++
+	sub := &loopbackSub{
+		id:        t.bus.nextID,
+		transport: t,
+		subject:   subj,
+		queue:     queue,
+		handler:   handler,
+	}
+	sub.cond = sync.NewCond(&sub.mutex)
+	t.bus.subs[sub.id] = sub
+	t.bus.mutex.Unlock()
+	t.subs[sub.id] = sub
+	go sub.run()
+	return sub, nil
+}
+
+// Flush .
+func (t *LoopbackTransport) Flush() error {
+	return nil
+}
+
+// Close unsubscribes all subscriptions of the transport.
+func (t *LoopbackTransport) Close() {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return
+	}
+	t.closed = true
+	subs := t.subs
+	t.subs = make(map[uint64]*loopbackSub)
+	t.mutex.Unlock()
+	for _, sub := range subs {
+		sub.stop()
+	}
+}
+
+// loopbackSub delivers messages in order on its own goroutine, like a NATS
+// subscription does.
+type loopbackSub struct {
+	id        uint64
+	transport *LoopbackTransport
+	subject   string
+	queue     string
+	handler   MsgHandler
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	pending []*Msg
+	stopped bool
+}
+
+func (sub *loopbackSub) enqueue(msg *Msg) {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	if sub.stopped {
+		return
+	}
+	sub.pending = append(sub.pending, msg)
+	sub.cond.Signal()
+}
+
+func (sub *loopbackSub) run() {
+	for {
+		sub.mutex.Lock()
+		for len(sub.pending) == 0 && !sub.stopped {
+			sub.cond.Wait()
+		}
+		if sub.stopped {
+			sub.mutex.Unlock()
+			return
+		}
+		msg := sub.pending[0]
+		sub.pending = sub.pending[1:]
+		sub.mutex.Unlock()
+		sub.handler(msg)
+	}
+}
+
+func (sub *loopbackSub) stop() {
+	bus := sub.transport.bus
+	bus.mutex.Lock()
+	delete(bus.subs, sub.id)
+	bus.mutex.Unlock()
+	sub.mutex.Lock()
+	sub.stopped = true
+	sub.pending = nil
+	sub.cond.Signal()
+	sub.mutex.Unlock()
+}
+
+// Unsubscribe .
+func (sub *loopbackSub) Unsubscribe() error {
+	t := sub.transport
+	t.mutex.Lock()
+	delete(t.subs, sub.id)
+	t.mutex.Unlock()
+	sub.stop()
+	return nil
+}
@@ -0,0 +1,115 @@
+package nprotoo
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSubjectMatches(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		subject string
+		match   bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.b", "a.b.c", false},
+		{"a.b.c", "a.b", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"*.b", "a.b", true},
+		{"a.*.c", "a.b.c", true},
+		{"a.>", "a.b", true},
+		{"a.>", "a.b.c", true},
+		{"a.>", "a", false},
+		{">", "a.b", true},
+		{"a.*.>", "a.b", false},
+		{"a.*.>", "a.b.c.d", true},
+	} {
+		if got := subjectMatches(c.pattern, c.subject); got != c.match {
+			t.Errorf("subjectMatches(%q, %q) = %v", c.pattern, c.subject, got)
+		}
+	}
+}
+
+func receive(t *testing.T, ch chan string) string {
+	t.Helper()
+	select {
+	case subject := <-ch:
+		return subject
+	case <-time.After(time.Second):
+		t.Fatalf("no message received")
+		return _EMPTY_
+	}
+}
+
+func TestLoopbackWildcards(t *testing.T) {
+	bus := NewLoopbackBus()
+	sub, pub := bus.Transport(), bus.Transport()
+	defer sub.Close()
+	defer pub.Close()
+	star, tail := make(chan string, 4), make(chan string, 4)
+	sub.Subscribe("room.*", func(msg *Msg) { star <- msg.Subject })
+	sub.Subscribe("room.>", func(msg *Msg) { tail <- msg.Subject })
+
+	pub.Publish("room.a", _EMPTY_, nil)
+	pub.Publish("room.a.b", _EMPTY_, nil)
+	pub.Publish("lobby.a", _EMPTY_, nil)
+	if got := receive(t, star); got != "room.a" {
+		t.Fatalf("room.* got %s", got)
+	}
+	if got := receive(t, tail); got != "room.a" {
+		t.Fatalf("room.> got %s", got)
+	}
+	if got := receive(t, tail); got != "room.a.b" {
+		t.Fatalf("room.> got %s", got)
+	}
+	select {
+	case got := <-star:
+		t.Fatalf("room.* got %s", got)
+	case got := <-tail:
+		t.Fatalf("room.> got %s", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLoopbackQueueGroups(t *testing.T) {
+	bus := NewLoopbackBus()
+	pub := bus.Transport()
+	defer pub.Close()
+	group, plain := make(chan string, 100), make(chan string, 100)
+	for i := 0; i < 3; i++ {
+		sub := bus.Transport()
+		defer sub.Close()
+		sub.QueueSubscribe("work", "workers", func(msg *Msg) { group <- msg.Subject })
+	}
+	other := bus.Transport()
+	defer other.Close()
+	other.Subscribe("work", func(msg *Msg) { plain <- msg.Subject })
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		pub.Publish("work", _EMPTY_, nil)
+	}
+	for i := 0; i < count; i++ {
+		receive(t, group)
+		receive(t, plain)
+	}
+	select {
+	case <-group:
+		t.Fatalf("queue group received a message twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestErrNoJetStream(t *testing.T) {
+	np := NewNatsProtooWithTransport(NewLoopbackTransport())
+	defer np.Close()
+	if _, err := np.jetStream(); err != ErrNoJetStream {
+		t.Fatalf("jetStream: got %v", err)
+	}
+	if errors.Is(ErrNoJetStream, ErrNoResponder) {
+		t.Fatalf("ErrNoJetStream matches ErrNoResponder")
+	}
+}
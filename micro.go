@@ -0,0 +1,141 @@
+package nprotoo
+
+import (
+	"regexp"
+	"time"
+)
+
+// StatsResponseType .
+const StatsResponseType = "io.nats.micro.v1.stats_response"
+
+var invalidEndpointChars = regexp.MustCompile(`[^A-Za-z0-9\-_]`)
+
+// MethodStats are the statistics of a method of an endpoint.
+type MethodStats struct {
+	NumRequests           int           `json:"num_requests"`
+	NumErrors             int           `json:"num_errors"`
+	LastError             string        `json:"last_error"`
+	ProcessingTime        time.Duration `json:"processing_time"`
+	AverageProcessingTime time.Duration `json:"average_processing_time"`
+}
+
+// EndpointStats are the statistics of an endpoint in $SRV.STATS responses,
+// Methods breaks them down by request method and is reported as data.
+type EndpointStats struct {
+	Name       string `json:"name"`
+	Subject    string `json:"subject"`
+	QueueGroup string `json:"queue_group,omitempty"`
+	MethodStats
+	Methods map[string]MethodStats `json:"data,omitempty"`
+}
+
+// ServiceStats is the response to $SRV.STATS requests.
+type ServiceStats struct {
+	ServiceIdentity
+	Type      string          `json:"type"`
+	Started   time.Time       `json:"started"`
+	Endpoints []EndpointStats `json:"endpoints"`
+}
+
+type endpointStats struct {
+	total   MethodStats
+	methods map[string]*MethodStats
+}
+
+func (m *MethodStats) record(elapsed time.Duration, e *Error) {
+	m.NumRequests++
+	m.ProcessingTime += elapsed
+	m.AverageProcessingTime = m.ProcessingTime / time.Duration(m.NumRequests)
+	if e != nil {
+		m.NumErrors++
+		m.LastError = e.Error()
+	}
+}
+
+// ExposeService registers a service with an endpoint for each channel
+// with a request listener but peer subjects, unless config lists
+// endpoints. Endpoints are named after their channel, so that they show
+// up in NATS micro tooling.
+func (np *NatsProtoo) ExposeService(config ServiceConfig) (*Service, error) {
+	if len(config.Endpoints) == 0 {
+		for _, channel := range np.serviceChannels() {
+			config.Endpoints = append(config.Endpoints, Endpoint{
+				Name:    invalidEndpointChars.ReplaceAllString(channel, "_"),
+				Subject: channel,
+			})
+		}
+	}
+	return np.RegisterService(config)
+}
+
+// observe records a handled request in the stats of the services exposing
+// channel.
+func (np *NatsProtoo) observe(channel string, method string, elapsed time.Duration, e *Error) {
+	np.mutex.Lock()
+	services := np.services
+	np.mutex.Unlock()
+	for _, s := range services {
+		s.record(channel, method, elapsed, e)
+	}
+}
+
+func (s *Service) record(channel string, method string, elapsed time.Duration, e *Error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats, found := s.stats[channel]
+	if !found {
+		return
+	}
+	stats.total.record(elapsed, e)
+	m, found := stats.methods[method]
+	if !found {
+		m = &MethodStats{}
+		stats.methods[method] = m
+	}
+	m.record(elapsed, e)
+}
+
+// Stats returns the statistics of the endpoints of the service.
+func (s *Service) Stats() ServiceStats {
+	response := ServiceStats{
+		ServiceIdentity: s.identity(),
+		Type:            StatsResponseType,
+		Started:         s.started,
+		Endpoints:       []EndpointStats{},
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, endpoint := range s.config.Endpoints {
+		es := EndpointStats{
+			Name:       endpoint.Name,
+			Subject:    endpoint.Subject,
+			QueueGroup: endpoint.QueueGroup,
+		}
+		if stats, found := s.stats[endpoint.Subject]; found {
+			es.MethodStats = stats.total
+			if len(stats.methods) > 0 {
+				es.Methods = make(map[string]MethodStats, len(stats.methods))
+				for method, m := range stats.methods {
+					es.Methods[method] = *m
+				}
+			}
+		}
+		response.Endpoints = append(response.Endpoints, es)
+	}
+	return response
+}
+
+// Reset clears the statistics of the service.
+func (s *Service) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.resetStats()
+}
+
+// resetStats, the caller must hold s.mutex unless s is not yet registered.
+func (s *Service) resetStats() {
+	s.stats = make(map[string]*endpointStats, len(s.config.Endpoints))
+	for _, endpoint := range s.config.Endpoints {
+		s.stats[endpoint.Subject] = &endpointStats{methods: make(map[string]*MethodStats)}
+	}
+}
@@ -0,0 +1,66 @@
+package nprotoo
+
+import (
+	"strings"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
+	nats "github.com/nats-io/nats.go"
+)
+
+// WithSharedReplyInbox makes all requestors of the NatsProtoo share a single
+// wildcard reply subscription, responses are routed by the last token of
+// the reply subject instead of one subscription per requestor.
+func WithSharedReplyInbox() Option {
+	return func(np *NatsProtoo) {
+		np.sharedReplies = true
+	}
+}
+
+// replyMux routes responses received on "<prefix>.*" to requestors.
+type replyMux struct {
+	prefix string
+	sub    TransportSubscription
+	routes map[string]*Requestor
+}
+
+// routeReplies registers req on the shared reply inbox and returns its reply subject.
+func (np *NatsProtoo) routeReplies(req *Requestor, token string) (string, error) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	if np.mux == nil {
+		mux := &replyMux{
+			prefix: nats.NewInbox(),
+			routes: make(map[string]*Requestor),
+		}
+		sub, err := np.transport.Subscribe(mux.prefix+".*", np.onMuxReply)
+		if err != nil {
+			return _EMPTY_, err
+		}
+		mux.sub = sub
+		np.mux = mux
+		np.transport.Flush()
+		logger.Debugf("Shared reply inbox [%s.*]", mux.prefix)
+	}
+	np.mux.routes[token] = req
+	return np.mux.prefix + "." + token, nil
+}
+
+func (np *NatsProtoo) unrouteReplies(token string) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	if np.mux != nil {
+		delete(np.mux.routes, token)
+	}
+}
+
+func (np *NatsProtoo) onMuxReply(msg *Msg) {
+	token := msg.Subject[strings.LastIndex(msg.Subject, ".")+1:]
+	np.mutex.Lock()
+	req, found := np.mux.routes[token]
+	np.mutex.Unlock()
+	if !found {
+		logger.Debugf("No requestor for reply [%s]", msg.Subject)
+		return
+	}
+	req.onReply(msg)
+}
@@ -0,0 +1,133 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"path"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
+	nats "github.com/nats-io/nats.go"
+)
+
+// Subscription identifies a listener registered on a channel.
+type Subscription struct {
+	id      uint64
+	channel string
+	np      *NatsProtoo
+	sub     TransportSubscription
+}
+
+// Channel .
+func (s *Subscription) Channel() string {
+	return s.channel
+}
+
+// Unsubscribe removes the listener, the channel is unsubscribed from NATS
+// once no listener is left on it.
+func (s *Subscription) Unsubscribe() {
+	if s.sub != nil {
+		if err := s.sub.Unsubscribe(); err != nil {
+			logger.Warnf("Unsubscribe %s %v", s.channel, err)
+		}
+		return
+	}
+	s.np.removeNotificationListener(s.channel, s.id)
+}
+
+type notificationListener struct {
+	id       uint64
+	method   string
+	listener BroadCastFunc
+}
+
+func (l notificationListener) matches(method string) bool {
+	if l.method == _EMPTY_ || l.method == "*" || l.method == method {
+		return true
+	}
+	matched, err := path.Match(l.method, method)
+	return err == nil && matched
+}
+
+// OnNotification registers listener for notifications of channel whose
+// method matches the method pattern, "*" and glob patterns like "peer*"
+// are supported.
+func (np *NatsProtoo) OnNotification(channel string, method string, listener BroadCastFunc) *Subscription {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	np.subscribeChannel(channel)
+	np.nextListenerID++
+	id := np.nextListenerID
+	np.notificationListeners[channel] = append(np.notificationListeners[channel], notificationListener{
+		id:       id,
+		method:   method,
+		listener: listener,
+	})
+	logger.Debugf("OnNotification: [channel:%s, method:%s, id:%d]", channel, method, id)
+	return &Subscription{id: id, channel: channel, np: np}
+}
+
+// Typed adapts handler into a BroadCastFunc decoding the notification data
+// into T, notifications failing to decode are logged and dropped.
+func Typed[T any](handler func(data T, notification Notification)) BroadCastFunc {
+	return func(notification Notification, subj string) {
+		var data T
+		if err := json.Unmarshal(notification.Data, &data); err != nil {
+			logger.Warnf("Decode notification [%s] on %s %v", notification.Method, subj, err)
+			return
+		}
+		handler(data, notification)
+	}
+}
+
+func (np *NatsProtoo) removeNotificationListener(channel string, id uint64) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	listeners := np.notificationListeners[channel]
+	for i, l := range listeners {
+		if l.id == id {
+			np.notificationListeners[channel] = append(listeners[:i:i], listeners[i+1:]...)
+			break
+		}
+	}
+	if len(np.notificationListeners[channel]) == 0 {
+		delete(np.notificationListeners, channel)
+	}
+	np.unsubscribeChannelIfIdle(channel)
+}
+
+// subscribeChannel subscribes channel once for all kinds of listeners, the
+// caller must hold np.mutex.
+func (np *NatsProtoo) subscribeChannel(channel string) {
+	if _, found := np.channelSubs[channel]; found {
+		return
+	}
+	sub, err := np.transport.QueueSubscribe(channel, _EMPTY_, np.onRequest(channel))
+	if err != nil {
+		logger.Errorf("Subscribe %s %v", channel, err)
+		return
+	}
+	np.channelSubs[channel] = sub
+	np.transport.Flush()
+}
+
+// unsubscribeChannelIfIdle drops the NATS subscription of a channel without
+// listeners, the caller must hold np.mutex.
+func (np *NatsProtoo) unsubscribeChannelIfIdle(channel string) {
+	if _, found := np.requestListener[channel]; found {
+		return
+	}
+	np.unsubscribe(CancelSubjectPrefix + channel)
+	if len(np.notificationListeners[channel]) > 0 {
+		return
+	}
+	np.unsubscribe(channel)
+}
+
+// unsubscribe drops the subscription of subj, the caller must hold np.mutex.
+func (np *NatsProtoo) unsubscribe(subj string) {
+	if sub, found := np.channelSubs[subj]; found {
+		delete(np.channelSubs, subj)
+		if err := sub.Unsubscribe(); err != nil && err != nats.ErrConnectionClosed {
+			logger.Warnf("Unsubscribe %s %v", subj, err)
+		}
+	}
+}
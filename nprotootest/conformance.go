@@ -0,0 +1,311 @@
+package nprotootest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nprotoo "github.com/cloudwebrtc/nats-protoo"
+)
+
+const (
+	waitTimeout = 5 * time.Second
+)
+
+// PairFunc returns a connected listener and requestor side NatsProtoo.
+type PairFunc func(t testing.TB) (listener *nprotoo.NatsProtoo, requestor *nprotoo.NatsProtoo)
+
+// ServerPair is a PairFunc over an embedded server.
+func ServerPair(t testing.TB) (*nprotoo.NatsProtoo, *nprotoo.NatsProtoo) {
+	return NewServer(t).Pair()
+}
+
+// RunConformance checks the request, notification and lifecycle semantics
+// of nprotoo over the pairs returned by newPair, e.g. ServerPair or
+// LoopbackPair.
+func RunConformance(t *testing.T, newPair PairFunc) {
+	t.Run("Accept", func(t *testing.T) { testAccept(t, newPair) })
+	t.Run("Reject", func(t *testing.T) { testReject(t, newPair) })
+	t.Run("ErrorData", func(t *testing.T) { testErrorData(t, newPair) })
+	t.Run("Timeout", func(t *testing.T) { testTimeout(t, newPair) })
+	t.Run("Cancel", func(t *testing.T) { testCancel(t, newPair) })
+	t.Run("Idempotency", func(t *testing.T) { testIdempotency(t, newPair) })
+	t.Run("Admission", func(t *testing.T) { testAdmission(t, newPair) })
+	t.Run("RequestorClose", func(t *testing.T) { testRequestorClose(t, newPair) })
+	t.Run("Broadcast", func(t *testing.T) { testBroadcast(t, newPair) })
+	t.Run("NotificationFilter", func(t *testing.T) { testNotificationFilter(t, newPair) })
+	t.Run("Unsubscribe", func(t *testing.T) { testUnsubscribe(t, newPair) })
+}
+
+func testAccept(t *testing.T, newPair PairFunc) {
+	listener, requestor := newPair(t)
+	listener.OnRequest("conformance.accept", Echo)
+	result, err := requestor.NewRequestor("conformance.accept").SyncRequest("echo", map[string]string{"key": "value"})
+	if err != nil {
+		t.Fatalf("accept: unexpected error %v", err)
+	}
+	var data map[string]string
+	if err := json.Unmarshal(result, &data); err != nil || data["key"] != "value" {
+		t.Fatalf("accept: got %s", result)
+	}
+}
+
+func testReject(t *testing.T, newPair PairFunc) {
+	listener, requestor := newPair(t)
+	listener.OnRequest("conformance.reject", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		reject(nprotoo.NotFoundCode, "Not found")
+	})
+	_, err := requestor.NewRequestor("conformance.reject").SyncRequest("missing", nil)
+	if err == nil || err.Code != nprotoo.NotFoundCode || err.Reason != "Not found" {
+		t.Fatalf("reject: got %v", err)
+	}
+	if !errors.Is(err, nprotoo.ErrNotFound) {
+		t.Fatalf("reject: %v is not ErrNotFound", err)
+	}
+
+	// Rejects with the codes of local errors must not match their sentinels.
+	for _, sentinel := range []*nprotoo.Error{nprotoo.ErrNoResponder, nprotoo.ErrTransportClosed, nprotoo.ErrCircuitOpen} {
+		code := sentinel.Code
+		listener.OnRequest("conformance.reject", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+			reject(code, "Rejected")
+		})
+		_, err := requestor.NewRequestor("conformance.reject").SyncRequest("fail", nil)
+		if err == nil || err.Code != code {
+			t.Fatalf("reject %d: got %v", code, err)
+		}
+		if errors.Is(err, sentinel) {
+			t.Fatalf("reject %d: %v matches %v", code, err, sentinel)
+		}
+	}
+	// A channel subscribed for notifications only has no request listener.
+	listener.OnNotification("conformance.noresponder", "*", func(nprotoo.Notification, string) {})
+	_, err = requestor.NewRequestor("conformance.noresponder").SyncRequest("missing", nil)
+	if !errors.Is(err, nprotoo.ErrNoResponder) {
+		t.Fatalf("no responder: got %v", err)
+	}
+}
+
+func testErrorData(t *testing.T, newPair PairFunc) {
+	listener, requestor := newPair(t)
+	listener.OnRequest("conformance.errordata", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		request.RejectError(nprotoo.NewError(409, "Conflict").WithData(map[string]int{"version": 2}))
+	})
+	_, err := requestor.NewRequestor("conformance.errordata").SyncRequest("update", nil)
+	if err == nil || err.Code != 409 {
+		t.Fatalf("error data: got %v", err)
+	}
+	var data map[string]int
+	if jsonErr := json.Unmarshal(err.Data, &data); jsonErr != nil || data["version"] != 2 {
+		t.Fatalf("error data: got %s", err.Data)
+	}
+}
+
+func testTimeout(t *testing.T, newPair PairFunc) {
+	listener, requestor := newPair(t)
+	listener.OnRequest("conformance.timeout", DropReplies(Echo))
+	req := requestor.NewRequestor("conformance.timeout")
+	req.SetRequestTimeout(200 * time.Millisecond)
+	_, err := req.SyncRequest("echo", nil)
+	if !errors.Is(err, nprotoo.ErrTimeout) {
+		t.Fatalf("timeout: got %v", err)
+	}
+}
+
+func testCancel(t *testing.T, newPair PairFunc) {
+	listener, requestor := newPair(t)
+	cancelled := make(chan struct{})
+	listener.OnRequest("conformance.cancel", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		// Block the listener, the cancel must reach it anyway.
+		<-request.Context().Done()
+		close(cancelled)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := requestor.NewRequestor("conformance.cancel").SyncRequestContext(ctx, "work", nil)
+	if !errors.Is(err, nprotoo.ErrCancelled) {
+		t.Fatalf("cancel: got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(waitTimeout):
+		t.Fatalf("cancel: handler context not cancelled")
+	}
+}
+
+func testIdempotency(t *testing.T, newPair PairFunc) {
+	listener, requestor := newPair(t)
+	listener.SetIdempotencyWindow(time.Minute)
+	var calls int32
+	listener.OnRequest("conformance.idempotency", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		accept(atomic.AddInt32(&calls, 1))
+	})
+	req := requestor.NewRequestor("conformance.idempotency")
+	for i := 0; i < 3; i++ {
+		done := make(chan *nprotoo.Error, 1)
+		req.RequestWithKey("join", nil, "join-1",
+			func(result nprotoo.RawMessage) {
+				if string(result) != "1" {
+					t.Errorf("idempotency: got response %s", result)
+				}
+				done <- nil
+			},
+			func(code int, reason string) {
+				done <- nprotoo.NewError(code, reason)
+			})
+		if err := waitError(t, done); err != nil {
+			t.Fatalf("idempotency: unexpected error %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("idempotency: handler ran %d times", n)
+	}
+
+	// The response to a request abandoned by its requestor is not cached,
+	// a retry with the same key runs the handler again.
+	var attempts int32
+	rejected := make(chan struct{})
+	listener.OnRequest("conformance.idempotency.cancel", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			<-request.Context().Done()
+			reject(nprotoo.CancelledCode, "Request cancelled")
+			close(rejected)
+			return
+		}
+		accept("done")
+	})
+	req = requestor.NewRequestor("conformance.idempotency.cancel")
+	req.SetRequestTimeout(100 * time.Millisecond)
+	send := func() *nprotoo.Error {
+		done := make(chan *nprotoo.Error, 1)
+		req.RequestWithKey("join", nil, "join-2",
+			func(result nprotoo.RawMessage) { done <- nil },
+			func(code int, reason string) { done <- nprotoo.NewError(code, reason) })
+		return waitError(t, done)
+	}
+	if err := send(); err == nil || err.Code != nprotoo.TimeoutCode {
+		t.Fatalf("idempotency: got %v, want timeout", err)
+	}
+	select {
+	case <-rejected:
+	case <-time.After(waitTimeout):
+		t.Fatalf("idempotency: handler context not cancelled")
+	}
+	req.SetRequestTimeout(waitTimeout)
+	if err := send(); err != nil {
+		t.Fatalf("idempotency: retry after cancel got %v", err)
+	}
+}
+
+func testAdmission(t *testing.T, newPair PairFunc) {
+	listener, requestor := newPair(t)
+	listener.SetAdmissionControl("conformance.admission", nprotoo.AdmissionConfig{
+		Caller: nprotoo.RateLimit{Rate: 0.1, Burst: 1},
+	})
+	listener.OnRequest("conformance.admission", Echo)
+	alice := nprotoo.WithPeer(context.Background(), "alice")
+	// Requestors of the same peer share its limit.
+	if _, err := requestor.NewRequestor("conformance.admission").SyncRequestContext(alice, "echo", nil); err != nil {
+		t.Fatalf("admission: unexpected error %v", err)
+	}
+	_, err := requestor.NewRequestor("conformance.admission").SyncRequestContext(alice, "echo", nil)
+	if !errors.Is(err, nprotoo.ErrRateLimited) || err.RetryAfter <= 0 {
+		t.Fatalf("admission: got %v", err)
+	}
+	bob := nprotoo.WithPeer(context.Background(), "bob")
+	if _, err := requestor.NewRequestor("conformance.admission").SyncRequestContext(bob, "echo", nil); err != nil {
+		t.Fatalf("admission: unexpected error %v", err)
+	}
+}
+
+func testRequestorClose(t *testing.T, newPair PairFunc) {
+	listener, requestor := newPair(t)
+	listener.OnRequest("conformance.close", DropReplies(Echo))
+	req := requestor.NewRequestor("conformance.close")
+	future := req.AsyncRequest("echo", nil)
+	time.Sleep(100 * time.Millisecond)
+	req.Close()
+	_, err := future.Await()
+	if !errors.Is(err, nprotoo.ErrTransportClosed) {
+		t.Fatalf("close: got %v", err)
+	}
+	if _, err := req.SyncRequest("echo", nil); !errors.Is(err, nprotoo.ErrTransportClosed) {
+		t.Fatalf("close: request after close got %v", err)
+	}
+}
+
+func testBroadcast(t *testing.T, newPair PairFunc) {
+	listener, requestor := newPair(t)
+	got := make(chan nprotoo.Notification, 4)
+	handler := func(data nprotoo.Notification, subj string) {
+		got <- data
+	}
+	// The same func registered twice is delivered twice.
+	listener.OnBroadcast("conformance.broadcast", handler)
+	listener.OnBroadcast("conformance.broadcast", handler)
+	requestor.NewBroadcaster("conformance.broadcast").Say("hello", map[string]string{"key": "value"})
+	for i := 0; i < 2; i++ {
+		data := waitNotification(t, got)
+		if data.Method != "hello" || data.Seq != 1 {
+			t.Fatalf("broadcast: got %+v", data)
+		}
+	}
+}
+
+func testNotificationFilter(t *testing.T, newPair PairFunc) {
+	listener, requestor := newPair(t)
+	got := make(chan nprotoo.Notification, 4)
+	listener.OnNotification("conformance.filter", "peer*", func(data nprotoo.Notification, subj string) {
+		got <- data
+	})
+	bc := requestor.NewBroadcaster("conformance.filter")
+	bc.Say("trackAdded", nil)
+	bc.Say("peerJoined", nil)
+	if data := waitNotification(t, got); data.Method != "peerJoined" {
+		t.Fatalf("filter: got %s", data.Method)
+	}
+}
+
+func testUnsubscribe(t *testing.T, newPair PairFunc) {
+	listener, requestor := newPair(t)
+	removed := make(chan nprotoo.Notification, 4)
+	kept := make(chan nprotoo.Notification, 4)
+	sub := listener.OnBroadcast("conformance.unsubscribe", func(data nprotoo.Notification, subj string) {
+		removed <- data
+	})
+	listener.OnBroadcast("conformance.unsubscribe", func(data nprotoo.Notification, subj string) {
+		kept <- data
+	})
+	sub.Unsubscribe()
+	requestor.NewBroadcaster("conformance.unsubscribe").Say("hello", nil)
+	waitNotification(t, kept)
+	select {
+	case data := <-removed:
+		t.Fatalf("unsubscribe: removed listener got %s", data.Method)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func waitNotification(t *testing.T, got <-chan nprotoo.Notification) nprotoo.Notification {
+	t.Helper()
+	select {
+	case data := <-got:
+		return data
+	case <-time.After(waitTimeout):
+		t.Fatalf("no notification within %v", waitTimeout)
+	}
+	return nprotoo.Notification{}
+}
+
+func waitError(t *testing.T, done <-chan *nprotoo.Error) *nprotoo.Error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(waitTimeout):
+		t.Fatalf("no response within %v", waitTimeout)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package nprotootest
+
+import (
+	"testing"
+
+	nprotoo "github.com/cloudwebrtc/nats-protoo"
+)
+
+func TestLoopback(t *testing.T) {
+	RunConformance(t, func(t testing.TB) (*nprotoo.NatsProtoo, *nprotoo.NatsProtoo) {
+		return LoopbackPair(t)
+	})
+}
+
+func TestLoopbackSharedReplyInbox(t *testing.T) {
+	RunConformance(t, func(t testing.TB) (*nprotoo.NatsProtoo, *nprotoo.NatsProtoo) {
+		return LoopbackPair(t, nprotoo.WithSharedReplyInbox())
+	})
+}
+
+func TestServer(t *testing.T) {
+	RunServerConformance(t)
+}
+
+func TestServerSharedReplyInbox(t *testing.T) {
+	RunServerConformance(t, nprotoo.WithSharedReplyInbox())
+}
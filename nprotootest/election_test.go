@@ -0,0 +1,98 @@
+package nprotootest
+
+import (
+	"testing"
+	"time"
+
+	nprotoo "github.com/cloudwebrtc/nats-protoo"
+)
+
+const electionTTL = time.Second
+
+func candidate(t *testing.T, np *nprotoo.NatsProtoo, id string) *nprotoo.LeaderElection {
+	t.Helper()
+	le, err := np.NewLeaderElection("conformance", nprotoo.ElectionConfig{TTL: electionTTL, ID: id})
+	if err != nil {
+		t.Fatalf("NewLeaderElection %s: %v", id, err)
+	}
+	t.Cleanup(le.Close)
+	return le
+}
+
+func waitLeader(t *testing.T, le *nprotoo.LeaderElection, timeout time.Duration) uint64 {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if token := le.Token(); token > 0 {
+			return token
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("not elected within %v", timeout)
+	return 0
+}
+
+func TestElectionTakeoverAfterExpiry(t *testing.T) {
+	s := NewServer(t)
+	// The connection of a is closed so that its renewals fail.
+	npA := nprotoo.NewNatsProtoo(s.URL())
+	a := candidate(t, npA, "a")
+	tokenA := waitLeader(t, a, waitTimeout)
+	b := candidate(t, s.Connect(), "b")
+	if b.IsLeader() || b.Leader() != "a" {
+		t.Fatalf("b elected while a leads, leader %q", b.Leader())
+	}
+
+	overlap := make(chan bool, 1)
+	b.OnElected(func(uint64) { overlap <- a.IsLeader() })
+	demoted := make(chan time.Time, 1)
+	a.OnDemoted(func() { demoted <- time.Now() })
+	closed := time.Now()
+	npA.Close()
+
+	select {
+	case at := <-demoted:
+		if at.Sub(closed) >= electionTTL {
+			t.Fatalf("a demoted %v after its last renewal", at.Sub(closed))
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("a not demoted")
+	}
+	if tokenB := waitLeader(t, b, waitTimeout); tokenB <= tokenA {
+		t.Fatalf("token of b %d not above token of a %d", tokenB, tokenA)
+	}
+	if <-overlap {
+		t.Fatalf("a still leader when b was elected")
+	}
+}
+
+func TestElectionResign(t *testing.T) {
+	s := NewServer(t)
+	a := candidate(t, s.Connect(), "a")
+	tokenA := waitLeader(t, a, waitTimeout)
+	b := candidate(t, s.Connect(), "b")
+	a.Resign()
+	if a.IsLeader() || a.Token() != 0 {
+		t.Fatalf("a leads after resigning")
+	}
+	// b sees the entry freed and takes over well before it expires.
+	// b sees the entry freed and takes over before a campaigns again.
+	tokenB := waitLeader(t, b, electionTTL/3)
+	if tokenB <= tokenA {
+		t.Fatalf("token of b %d not above token of a %d", tokenB, tokenA)
+	}
+}
+
+func TestElectionTokensIncrease(t *testing.T) {
+	s := NewServer(t)
+	a := candidate(t, s.Connect(), "a")
+	last := waitLeader(t, a, waitTimeout)
+	for term := 0; term < 3; term++ {
+		a.Resign()
+		token := waitLeader(t, a, waitTimeout)
+		if token <= last {
+			t.Fatalf("term %d token %d not above %d", term, token, last)
+		}
+		last = token
+	}
+}
@@ -0,0 +1,132 @@
+package nprotootest
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nprotoo "github.com/cloudwebrtc/nats-protoo"
+)
+
+// RunServerConformance runs RunConformance over an embedded server with
+// options, followed by the cases that drop connections or restart it.
+func RunServerConformance(t *testing.T, options ...nprotoo.Option) {
+	RunConformance(t, func(t testing.TB) (*nprotoo.NatsProtoo, *nprotoo.NatsProtoo) {
+		return NewServer(t).Pair(options...)
+	})
+	t.Run("Reconnect", func(t *testing.T) { testReconnect(t, options) })
+	t.Run("Restart", func(t *testing.T) { testRestart(t, options) })
+	t.Run("PendingFail", func(t *testing.T) { testPendingFail(t, options) })
+	t.Run("PendingResend", func(t *testing.T) { testPendingResend(t, options) })
+}
+
+// reconnected returns a channel closed once np reconnected.
+func reconnected(np *nprotoo.NatsProtoo) <-chan struct{} {
+	done := make(chan struct{})
+	var once int32
+	np.OnReconnected(func(nprotoo.ReconnectedEvent) {
+		if atomic.CompareAndSwapInt32(&once, 0, 1) {
+			close(done)
+		}
+	})
+	return done
+}
+
+func waitClosed(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(waitTimeout):
+		t.Fatalf("%s: timed out", what)
+	}
+}
+
+func testReconnect(t *testing.T, options []nprotoo.Option) {
+	s := NewServer(t)
+	listener, requestor := s.Pair(options...)
+	listener.OnRequest("conformance.reconnect", Echo)
+	disconnected := make(chan struct{}, 1)
+	requestor.OnDisconnected(func(nprotoo.DisconnectedEvent) {
+		select {
+		case disconnected <- struct{}{}:
+		default:
+		}
+	})
+	listenerBack, requestorBack := reconnected(listener), reconnected(requestor)
+	s.DropConnections()
+	select {
+	case <-disconnected:
+	case <-time.After(waitTimeout):
+		t.Fatalf("reconnect: no disconnected event")
+	}
+	waitClosed(t, listenerBack, "reconnect listener")
+	waitClosed(t, requestorBack, "reconnect requestor")
+	if _, err := requestor.NewRequestor("conformance.reconnect").SyncRequest("echo", nil); err != nil {
+		t.Fatalf("reconnect: request after reconnect got %v", err)
+	}
+}
+
+func testRestart(t *testing.T, options []nprotoo.Option) {
+	s := NewServer(t)
+	listener, requestor := s.Pair(options...)
+	listener.OnRequest("conformance.restart", Echo)
+	req := requestor.NewRequestor("conformance.restart")
+	if _, err := req.SyncRequest("echo", nil); err != nil {
+		t.Fatalf("restart: unexpected error %v", err)
+	}
+	listenerBack, requestorBack := reconnected(listener), reconnected(requestor)
+	s.Restart()
+	waitClosed(t, listenerBack, "restart listener")
+	waitClosed(t, requestorBack, "restart requestor")
+	// Requestors and listeners created before the restart keep working.
+	if _, err := req.SyncRequest("echo", nil); err != nil {
+		t.Fatalf("restart: request after restart got %v", err)
+	}
+}
+
+func testPendingFail(t *testing.T, options []nprotoo.Option) {
+	s := NewServer(t)
+	listener, requestor := s.connectDirect(options...), s.Connect(options...)
+	listener.OnRequest("conformance.pendingfail", SlowHandler(time.Minute, Echo))
+	req := requestor.NewRequestor("conformance.pendingfail")
+	req.SetPendingPolicy(nprotoo.PendingFail)
+	future := req.AsyncRequest("echo", nil)
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	s.DropConnections()
+	_, err := future.Await()
+	if !errors.Is(err, nprotoo.ErrTransportClosed) || time.Since(start) > waitTimeout {
+		t.Fatalf("pending fail: got %v after %v", err, time.Since(start))
+	}
+}
+
+func testPendingResend(t *testing.T, options []nprotoo.Option) {
+	s := NewServer(t)
+	// Only the requestor loses its connection, the listener is there to
+	// receive the resent request.
+	listener, requestor := s.connectDirect(options...), s.Connect(options...)
+	var attempts int32
+	received := make(chan struct{}, 1)
+	listener.OnRequest("conformance.pendingresend", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			// The response to the first attempt is lost.
+			received <- struct{}{}
+			return
+		}
+		accept("resent")
+	})
+	req := requestor.NewRequestor("conformance.pendingresend")
+	req.SetRequestTimeout(2 * waitTimeout)
+	req.SetPendingPolicy(nprotoo.PendingResend, "join")
+	future := req.AsyncRequest("join", nil)
+	waitClosed(t, received, "pending resend first attempt")
+	s.DropConnections()
+	result, err := future.Await()
+	if err != nil || string(result) != `"resent"` {
+		t.Fatalf("pending resend: got %s %v", result, err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Fatalf("pending resend: handler ran %d times", n)
+	}
+}
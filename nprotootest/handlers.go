@@ -0,0 +1,35 @@
+package nprotootest
+
+import (
+	"time"
+
+	nprotoo "github.com/cloudwebrtc/nats-protoo"
+)
+
+// SlowHandler runs handler after delay, or rejects the request with
+// CancelledCode if the requestor abandons it first.
+func SlowHandler(delay time.Duration, handler nprotoo.RequestFunc) nprotoo.RequestFunc {
+	return func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		go func() {
+			select {
+			case <-time.After(delay):
+				handler(request, accept, reject)
+			case <-request.Context().Done():
+				reject(nprotoo.CancelledCode, "Request cancelled")
+			}
+		}()
+	}
+}
+
+// DropReplies runs handler but never sends its response, so that the
+// requestor times out.
+func DropReplies(handler nprotoo.RequestFunc) nprotoo.RequestFunc {
+	return func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		handler(request, func(data interface{}) {}, func(errorCode int, errorReason string) {})
+	}
+}
+
+// Echo accepts every request with its data.
+func Echo(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+	accept(request.Data)
+}
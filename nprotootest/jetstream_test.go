@@ -0,0 +1,112 @@
+package nprotootest
+
+import (
+	"testing"
+	"time"
+
+	nprotoo "github.com/cloudwebrtc/nats-protoo"
+)
+
+func expectNotification(t *testing.T, ch chan string, method string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != method {
+			t.Fatalf("got notification %s, want %s", got, method)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("notification %s not received", method)
+	}
+}
+
+func TestDurableBroadcast(t *testing.T) {
+	s := NewServer(t)
+	bc, err := s.Connect().NewDurableBroadcaster("durable.room")
+	if err != nil {
+		t.Fatalf("NewDurableBroadcaster: %v", err)
+	}
+	received := make(chan string, 10)
+	listener := func(data nprotoo.Notification, subj string) { received <- data.Method }
+
+	consumer := nprotoo.NewNatsProtoo(s.URL())
+	if _, err := consumer.OnDurableBroadcast("durable.room", "worker", listener); err != nil {
+		t.Fatalf("OnDurableBroadcast: %v", err)
+	}
+	ack, err := bc.Say("one", nil)
+	if err != nil || ack == nil || ack.Sequence != 1 {
+		t.Fatalf("Say: got %v %v", ack, err)
+	}
+	expectNotification(t, received, "one")
+
+	// Notifications sent while the consumer is away are delivered once it
+	// reconnects, the acked one is not.
+	consumer.Close()
+	bc.Say("two", nil)
+	bc.Say("three", nil)
+	if _, err := s.Connect().OnDurableBroadcast("durable.room", "worker", listener); err != nil {
+		t.Fatalf("OnDurableBroadcast: %v", err)
+	}
+	expectNotification(t, received, "two")
+	expectNotification(t, received, "three")
+	select {
+	case got := <-received:
+		t.Fatalf("unexpected notification %s", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDurableStreamPerChannel(t *testing.T) {
+	s := NewServer(t)
+	np := s.Connect()
+	for _, channel := range []string{"durable.a.b", "durable.a_b"} {
+		bc, err := np.NewDurableBroadcaster(channel)
+		if err != nil {
+			t.Fatalf("NewDurableBroadcaster %s: %v", channel, err)
+		}
+		ack, err := bc.Say("hello", nil)
+		if err != nil {
+			t.Fatalf("Say on %s: %v", channel, err)
+		}
+		if ack.Sequence != 1 {
+			t.Fatalf("channel %s shares stream %s", channel, ack.Stream)
+		}
+	}
+}
+
+func TestDurableReplayFromSequence(t *testing.T) {
+	s := NewServer(t)
+	// Notifications of two publishers, numbered apart by their Seq.
+	first, err := s.Connect().NewDurableBroadcaster("durable.replay")
+	if err != nil {
+		t.Fatalf("NewDurableBroadcaster: %v", err)
+	}
+	second, err := s.Connect().NewDurableBroadcaster("durable.replay")
+	if err != nil {
+		t.Fatalf("NewDurableBroadcaster: %v", err)
+	}
+	var from uint64
+	for i, bc := range []*nprotoo.Broadcaster{first, first, first, second, first} {
+		ack, err := bc.Say(string(rune('a'+i)), nil)
+		if err != nil {
+			t.Fatalf("Say: %v", err)
+		}
+		if i == 2 {
+			from = ack.Sequence
+		}
+	}
+
+	received := make(chan nprotoo.Notification, 10)
+	s.Connect().OnBroadcast("durable.replay", func(data nprotoo.Notification, subj string) {
+		received <- data
+	}, nprotoo.ReplayFromSequence(from))
+	for _, method := range []string{"c", "d", "e"} {
+		select {
+		case data := <-received:
+			if data.Method != method || !data.Replayed || data.StreamSeq < from {
+				t.Fatalf("got %s replayed:%v streamSeq:%d, want %s", data.Method, data.Replayed, data.StreamSeq, method)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("notification %s not replayed", method)
+		}
+	}
+}
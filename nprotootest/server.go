@@ -0,0 +1,202 @@
+// Package nprotootest runs an embedded NATS server for tests of code using
+// nprotoo, with helpers to simulate transport failures.
+package nprotootest
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	nprotoo "github.com/cloudwebrtc/nats-protoo"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+const (
+	readyTimeout = 10 * time.Second
+)
+
+// Server is an embedded NATS server with JetStream enabled. Clients connect
+// through a TCP proxy so that their connections can be dropped.
+type Server struct {
+	t      testing.TB
+	mutex  sync.Mutex
+	opts   server.Options
+	server *server.Server
+	proxy  *proxy
+}
+
+// NewServer starts an embedded server on a random port, it is shut down
+// when the test ends.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	s := &Server{
+		t: t,
+		opts: server.Options{
+			Host:      "127.0.0.1",
+			Port:      server.RANDOM_PORT,
+			NoLog:     true,
+			NoSigs:    true,
+			JetStream: true,
+			StoreDir:  t.TempDir(),
+		},
+	}
+	s.start()
+	// Keep the port across restarts.
+	s.opts.Port = s.server.Addr().(*net.TCPAddr).Port
+	p, err := newProxy(s.server.Addr().String())
+	if err != nil {
+		t.Fatalf("nprotootest: proxy: %v", err)
+	}
+	s.proxy = p
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func (s *Server) start() {
+	s.t.Helper()
+	opts := s.opts
+	srv, err := server.NewServer(&opts)
+	if err != nil {
+		s.t.Fatalf("nprotootest: server: %v", err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(readyTimeout) {
+		s.t.Fatalf("nprotootest: server not ready")
+	}
+	s.mutex.Lock()
+	s.server = srv
+	s.mutex.Unlock()
+}
+
+// URL is the address clients connect to, through the proxy.
+func (s *Server) URL() string {
+	return "nats://" + s.proxy.addr()
+}
+
+// Connect returns a NatsProtoo connected to the server, closed when the test ends.
+func (s *Server) Connect(options ...nprotoo.Option) *nprotoo.NatsProtoo {
+	np := nprotoo.NewNatsProtoo(s.URL(), options...)
+	s.t.Cleanup(np.Close)
+	return np
+}
+
+// Pair returns a listener and a requestor side NatsProtoo on separate connections.
+func (s *Server) Pair(options ...nprotoo.Option) (listener *nprotoo.NatsProtoo, requestor *nprotoo.NatsProtoo) {
+	return s.Connect(options...), s.Connect(options...)
+}
+
+// connectDirect returns a NatsProtoo connected to the server without the
+// proxy, so that it keeps its connection through DropConnections.
+func (s *Server) connectDirect(options ...nprotoo.Option) *nprotoo.NatsProtoo {
+	s.mutex.Lock()
+	url := s.server.ClientURL()
+	s.mutex.Unlock()
+	np := nprotoo.NewNatsProtoo(url, options...)
+	s.t.Cleanup(np.Close)
+	return np
+}
+
+// DropConnections closes the connections of all clients, they reconnect
+// right away.
+func (s *Server) DropConnections() {
+	s.proxy.drop()
+}
+
+// Restart shuts the server down and starts it again on the same port and
+// store, clients reconnect once it is back.
+func (s *Server) Restart() {
+	s.t.Helper()
+	s.mutex.Lock()
+	srv := s.server
+	s.mutex.Unlock()
+	srv.Shutdown()
+	srv.WaitForShutdown()
+	s.start()
+}
+
+// Shutdown stops the server and the proxy.
+func (s *Server) Shutdown() {
+	s.mutex.Lock()
+	srv := s.server
+	s.mutex.Unlock()
+	s.proxy.close()
+	srv.Shutdown()
+}
+
+// proxy forwards client connections to the server.
+type proxy struct {
+	mutex    sync.Mutex
+	target   string
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+}
+
+func newProxy(target string) (*proxy, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &proxy{target: target, listener: l, conns: make(map[net.Conn]struct{})}
+	go p.serve()
+	return p, nil
+}
+
+func (p *proxy) addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *proxy) serve() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", p.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		p.mutex.Lock()
+		p.conns[client] = struct{}{}
+		p.conns[upstream] = struct{}{}
+		p.mutex.Unlock()
+		go p.pipe(client, upstream)
+		go p.pipe(upstream, client)
+	}
+}
+
+func (p *proxy) pipe(dst net.Conn, src net.Conn) {
+	io.Copy(dst, src)
+	dst.Close()
+	src.Close()
+	p.mutex.Lock()
+	delete(p.conns, dst)
+	delete(p.conns, src)
+	p.mutex.Unlock()
+}
+
+func (p *proxy) drop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+}
+
+func (p *proxy) close() {
+	p.listener.Close()
+	p.drop()
+}
+
+// LoopbackPair returns a listener and a requestor side NatsProtoo sharing an
+// in-memory bus, for tests without any server.
+func LoopbackPair(t testing.TB, options ...nprotoo.Option) (listener *nprotoo.NatsProtoo, requestor *nprotoo.NatsProtoo) {
+	bus := nprotoo.NewLoopbackBus()
+	listener = nprotoo.NewNatsProtooWithTransport(bus.Transport(), options...)
+	requestor = nprotoo.NewNatsProtooWithTransport(bus.Transport(), options...)
+	t.Cleanup(listener.Close)
+	t.Cleanup(requestor.Close)
+	return listener, requestor
+}
@@ -0,0 +1,58 @@
+package nprotootest
+
+import (
+	"testing"
+	"time"
+
+	nprotoo "github.com/cloudwebrtc/nats-protoo"
+)
+
+func shardChannel(nodeID string) string {
+	return "conformance.shard." + nodeID
+}
+
+func waitRebalance(t *testing.T, events <-chan nprotoo.RebalanceEvent) nprotoo.RebalanceEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(waitTimeout):
+		t.Fatalf("no rebalance")
+		return nprotoo.RebalanceEvent{}
+	}
+}
+
+func TestShardRebalanceOnPresence(t *testing.T) {
+	listener, requestor := LoopbackPair(t)
+	listener.OnRequest(shardChannel(listener.NodeID()), Echo)
+	presence := nprotoo.PresenceConfig{Interval: 50 * time.Millisecond}
+	if err := requestor.StartPresence(presence); err != nil {
+		t.Fatalf("StartPresence: %v", err)
+	}
+	defer requestor.StopPresence()
+
+	sr := requestor.NewShardedRequestor(nprotoo.ShardConfig{Channel: shardChannel})
+	defer sr.Close()
+	events := make(chan nprotoo.RebalanceEvent, 4)
+	sr.OnRebalance(func(e nprotoo.RebalanceEvent) { events <- e })
+
+	if err := listener.StartPresence(presence); err != nil {
+		t.Fatalf("StartPresence: %v", err)
+	}
+	event := waitRebalance(t, events)
+	if len(event.Joined) != 1 || event.Joined[0] != listener.NodeID() || len(event.Left) != 0 {
+		t.Fatalf("got joined %v left %v", event.Joined, event.Left)
+	}
+	if owner := sr.Owner("room-1"); owner != listener.NodeID() {
+		t.Fatalf("room-1 owned by %q", owner)
+	}
+	if _, err := sr.SyncRequest("room-1", "echo", nil); err != nil {
+		t.Fatalf("sharded request: %v", err)
+	}
+
+	listener.StopPresence()
+	event = waitRebalance(t, events)
+	if len(event.Left) != 1 || event.Left[0] != listener.NodeID() || len(event.Nodes) != 0 {
+		t.Fatalf("got left %v nodes %v", event.Left, event.Nodes)
+	}
+}
@@ -0,0 +1,33 @@
+package nprotoo
+
+import (
+	nats "github.com/nats-io/nats.go"
+)
+
+// Option configures a NatsProtoo at creation.
+type Option func(np *NatsProtoo)
+
+// WithReconnectBufSize bounds the bytes buffered by the client while
+// reconnecting, publishing beyond it fails with TransportClosedCode.
+// A negative size disables buffering.
+func WithReconnectBufSize(size int) Option {
+	return func(np *NatsProtoo) {
+		np.natsOpts = append(np.natsOpts, nats.ReconnectBufSize(size))
+	}
+}
+
+// WithNodeID sets the ID announced by presence heartbeats, it defaults to
+// a random ID.
+func WithNodeID(id string) Option {
+	return func(np *NatsProtoo) {
+		np.nodeID = id
+	}
+}
+
+// WithNatsOptions passes extra options to nats.Connect, handlers set here
+// replace the ones emitting NatsProtoo events.
+func WithNatsOptions(opts ...nats.Option) Option {
+	return func(np *NatsProtoo) {
+		np.natsOpts = append(np.natsOpts, opts...)
+	}
+}
@@ -0,0 +1,234 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
+)
+
+const (
+	// PresenceSubject carries the heartbeats of all nodes.
+	PresenceSubject = "_NPROTOO.PRESENCE"
+
+	presenceExpiryFactor = 3
+)
+
+// NodeInfo is announced by a node in its heartbeats.
+type NodeInfo struct {
+	ID string `json:"id"`
+	// Channels the node has request listeners on, but peer subjects.
+	Channels []string          `json:"channels"`
+	Load     float64           `json:"load"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// LastSeen is the arrival time of the latest heartbeat.
+	LastSeen time.Time `json:"-"`
+}
+
+// PresenceConfig .
+type PresenceConfig struct {
+	// Interval between heartbeats, defaults to 5s.
+	Interval time.Duration
+	// Expiry after which a silent node is down, defaults to three intervals.
+	Expiry time.Duration
+	// Load returns the load announced in each heartbeat.
+	Load     func() float64
+	Metadata map[string]string
+}
+
+type heartbeat struct {
+	NodeInfo
+	Leaving bool `json:"leaving,omitempty"`
+}
+
+type presence struct {
+	np     *NatsProtoo
+	config PresenceConfig
+	sub    TransportSubscription
+	stop   chan struct{}
+	done   chan struct{}
+	mutex  sync.Mutex
+	nodes  map[string]NodeInfo
+}
+
+// NodeID returns the ID announced by presence heartbeats.
+func (np *NatsProtoo) NodeID() string {
+	return np.nodeID
+}
+
+// StartPresence announces the node on PresenceSubject every interval and
+// tracks the other nodes, emitting NodeUpEvent and NodeDownEvent.
+func (np *NatsProtoo) StartPresence(config PresenceConfig) error {
+	if config.Interval <= 0 {
+		config.Interval = pingPeriod
+	}
+	if config.Expiry <= 0 {
+		config.Expiry = presenceExpiryFactor * config.Interval
+	}
+	p := &presence{
+		np:     np,
+		config: config,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		nodes:  make(map[string]NodeInfo),
+	}
+	np.mutex.Lock()
+	if np.presence != nil {
+		np.mutex.Unlock()
+		return nil
+	}
+	np.presence = p
+	np.mutex.Unlock()
+
+	sub, err := np.transport.Subscribe(PresenceSubject, p.onHeartbeat)
+	if err != nil {
+		np.mutex.Lock()
+		np.presence = nil
+		np.mutex.Unlock()
+		return ErrTransportClosed.Wrap(err)
+	}
+	p.sub = sub
+	np.transport.Flush()
+	logger.Infof("Start presence of node %s every %v", np.nodeID, config.Interval)
+	p.announce(false)
+	go p.run()
+	return nil
+}
+
+// StopPresence announces that the node leaves and stops tracking others.
+func (np *NatsProtoo) StopPresence() {
+	np.mutex.Lock()
+	p := np.presence
+	np.presence = nil
+	np.mutex.Unlock()
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.sub.Unsubscribe()
+	p.announce(true)
+	logger.Infof("Stop presence of node %s", np.nodeID)
+}
+
+// Nodes returns the other live nodes, ordered by ID.
+func (np *NatsProtoo) Nodes() []NodeInfo {
+	np.mutex.Lock()
+	p := np.presence
+	np.mutex.Unlock()
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	nodes := make([]NodeInfo, 0, len(p.nodes))
+	for _, node := range p.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+func (p *presence) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.announce(false)
+			p.expire(time.Now())
+		}
+	}
+}
+
+// localNode returns the NodeInfo of this node, without load and metadata.
+func (np *NatsProtoo) localNode() NodeInfo {
+	return NodeInfo{ID: np.nodeID, Channels: np.serviceChannels()}
+}
+
+// serviceChannels returns the channels with a request listener in order,
+// but those of single peers under PeerSubjectPrefix, a bridge may serve
+// thousands of them.
+func (np *NatsProtoo) serviceChannels() []string {
+	np.mutex.Lock()
+	channels := make([]string, 0, len(np.requestListener))
+	for channel := range np.requestListener {
+		if !strings.HasPrefix(channel, PeerSubjectPrefix) {
+			channels = append(channels, channel)
+		}
+	}
+	np.mutex.Unlock()
+	sort.Strings(channels)
+	return channels
+}
+
+func (p *presence) announce(leaving bool) {
+	np := p.np
+	hb := heartbeat{
+		NodeInfo: np.localNode(),
+		Leaving:  leaving,
+	}
+	hb.Metadata = p.config.Metadata
+	if p.config.Load != nil {
+		hb.Load = p.config.Load()
+	}
+	payload, err := json.Marshal(hb)
+	if err != nil {
+		logger.Errorf("Marshal %v", err)
+		return
+	}
+	np.Send(payload, PresenceSubject, _EMPTY_)
+}
+
+func (p *presence) onHeartbeat(msg *Msg) {
+	var hb heartbeat
+	if err := json.Unmarshal(msg.Data, &hb); err != nil {
+		logger.Errorf("Invalid heartbeat %v", err)
+		return
+	}
+	if hb.ID == p.np.nodeID {
+		return
+	}
+	p.mutex.Lock()
+	_, known := p.nodes[hb.ID]
+	if hb.Leaving {
+		delete(p.nodes, hb.ID)
+		p.mutex.Unlock()
+		if known {
+			logger.Infof("Node %s left", hb.ID)
+			p.np.emit(NodeDownEvent{Node: hb.NodeInfo, Reason: "left"})
+		}
+		return
+	}
+	hb.LastSeen = time.Now()
+	p.nodes[hb.ID] = hb.NodeInfo
+	p.mutex.Unlock()
+	if !known {
+		logger.Infof("Node %s up, channels %v", hb.ID, hb.Channels)
+		p.np.emit(NodeUpEvent{Node: hb.NodeInfo})
+		// Let the new node learn about us without waiting an interval.
+		p.announce(false)
+	}
+}
+
+func (p *presence) expire(now time.Time) {
+	p.mutex.Lock()
+	var expired []NodeInfo
+	for id, node := range p.nodes {
+		if now.Sub(node.LastSeen) > p.config.Expiry {
+			delete(p.nodes, id)
+			expired = append(expired, node)
+		}
+	}
+	p.mutex.Unlock()
+	for _, node := range expired {
+		logger.Warnf("Node %s down, silent since %v", node.ID, node.LastSeen)
+		p.np.emit(NodeDownEvent{Node: node, Reason: "expired"})
+	}
+}
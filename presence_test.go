@@ -0,0 +1,18 @@
+package nprotoo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLocalNodeSkipsPeerSubjects(t *testing.T) {
+	np := NewNatsProtooWithTransport(NewLoopbackBus().Transport())
+	defer np.Close()
+	noop := func(request Request, accept RespondFunc, reject RejectFunc) {}
+	np.OnRequest("svc", noop)
+	np.OnRequest(PeerSubjectPrefix+"alice", noop)
+	np.OnRequest(PeerSubjectPrefix+"bob", noop)
+	if got := np.localNode().Channels; !reflect.DeepEqual(got, []string{"svc"}) {
+		t.Fatalf("channels %v, want [svc]", got)
+	}
+}
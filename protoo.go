@@ -1,11 +1,10 @@
 package nprotoo
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
-	"reflect"
 	"sync"
 	"time"
 
@@ -22,96 +21,181 @@ const (
 
 // NatsProtoo .
 type NatsProtoo struct {
+	// Deprecated: the string-keyed events are kept for compatibility, use
+	// OnClose, OnError, OnDisconnected, OnReconnected or Events instead.
 	emission.Emitter
-	nc                 *nats.Conn
-	mutex              *sync.Mutex
-	subj               string
-	closed             bool
-	requestListener    map[string]RequestFunc
-	broadcastListeners map[string][]BroadCastFunc
+	*eventHub
+	transport         Transport
+	mutex             *sync.Mutex
+	subj              string
+	closed            bool
+	requestListener   map[string]RequestFunc
+	idempotencyStore  IdempotencyStore
+	idempotencyWindow time.Duration
+	idempotentPending map[string]*pendingIdempotent
+	idempotentSwept   time.Time
+	admission         map[string]*admissionController
+	inflight          map[string]context.CancelFunc
+	cancelled         map[string]time.Time
+	natsOpts          []nats.Option
+	sharedReplies     bool
+	mux               *replyMux
+
+	channelSubs           map[string]TransportSubscription
+	notificationListeners map[string][]notificationListener
+	nextListenerID        uint64
+	js                    nats.JetStreamContext
+	publisherID           string
+	sequences             map[string]uint64
+	nodeID                string
+	presence              *presence
+	services              []*Service
 }
 
 // NewNatsProtoo .
-func NewNatsProtoo(server string) *NatsProtoo {
-	var np NatsProtoo
-	np.closed = false
+func NewNatsProtoo(server string, options ...Option) *NatsProtoo {
+	np := newNatsProtoo(options)
 	// Connect Options.
 	opts := []nats.Option{nats.Name("NATS Protoo")}
-	opts = setupConnOptions(opts)
+	opts = np.setupConnOptions(opts)
+	opts = append(opts, np.natsOpts...)
 	// Connect to NATS
 	nc, err := nats.Connect(server, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	np.nc = nc
-	np.nc.SetClosedHandler(func(nc *nats.Conn) {
-		logger.Warnf("%s [%v]", "nats nc closed", nc.LastError)
-		np.Emit("close", 0, nc.LastError().Error)
-		np.closed = true
-	})
+	np.transport = NewNatsTransport(nc)
+	logger.Infof("New Nats Protoo: nats => %s", server)
+	return np
+}
+
+// NewNatsProtooWithTransport returns a NatsProtoo over an existing
+// transport, such as a LoopbackTransport. Connection events are only
+// emitted by NewNatsProtoo.
+func NewNatsProtooWithTransport(transport Transport, options ...Option) *NatsProtoo {
+	np := newNatsProtoo(options)
+	np.transport = transport
+	logger.Infof("New Nats Protoo: transport => %T", transport)
+	return np
+}
+
+func newNatsProtoo(options []Option) *NatsProtoo {
+	var np NatsProtoo
+	np.closed = false
 	np.Emitter = *emission.NewEmitter()
+	np.eventHub = newEventHub(&np.Emitter)
 	np.mutex = new(sync.Mutex)
 	np.requestListener = make(map[string]RequestFunc)
-	np.broadcastListeners = make(map[string][]BroadCastFunc)
-	logger.Infof("New Nats Protoo: nats => %s", server)
+	np.idempotentPending = make(map[string]*pendingIdempotent)
+	np.admission = make(map[string]*admissionController)
+	np.inflight = make(map[string]context.CancelFunc)
+	np.cancelled = make(map[string]time.Time)
+	np.channelSubs = make(map[string]TransportSubscription)
+	np.notificationListeners = make(map[string][]notificationListener)
+	np.publisherID, _ = GenerateRandomString(12)
+	np.sequences = make(map[string]uint64)
+	np.nodeID = np.publisherID
+	for _, option := range options {
+		option(&np)
+	}
 	return &np
 }
 
+// conn returns the NATS connection, nil on other transports.
+func (np *NatsProtoo) conn() *nats.Conn {
+	if t, ok := np.transport.(*NatsTransport); ok {
+		return t.Conn()
+	}
+	return nil
+}
+
 func (np *NatsProtoo) NewRequestor(channel string) *Requestor {
-	return newRequestor(channel, np, np.nc)
+	return newRequestor(channel, np)
 }
 
 func (np *NatsProtoo) OnRequest(channel string, listener RequestFunc) {
 	np.mutex.Lock()
 	defer np.mutex.Unlock()
-	if _, found := np.requestListener[channel]; !found {
-		np.nc.QueueSubscribe(channel, _EMPTY_, np.onRequest)
-		np.nc.Flush()
-	}
+	np.subscribeChannel(channel)
+	np.subscribeCancel(channel)
 	np.requestListener[channel] = listener
 }
 
-func (np *NatsProtoo) NewBroadcaster(channel string) *Broadcaster {
-	return newBroadcaster(channel, np, np.nc)
-}
-
-func (np *NatsProtoo) OnBroadcast(channel string, listener BroadCastFunc) {
+// OffRequest removes the request listener of channel.
+func (np *NatsProtoo) OffRequest(channel string) {
 	np.mutex.Lock()
 	defer np.mutex.Unlock()
+	delete(np.requestListener, channel)
+	np.unsubscribeChannelIfIdle(channel)
+}
 
-	if _, found := np.broadcastListeners[channel]; !found {
-		np.nc.QueueSubscribe(channel, _EMPTY_, np.onRequest)
-		np.nc.Flush()
-		np.broadcastListeners[channel] = make([]BroadCastFunc, 0)
-	}
+func (np *NatsProtoo) NewBroadcaster(channel string) *Broadcaster {
+	return newBroadcaster(channel, np)
+}
 
-	if !listenerIsContain(np.broadcastListeners[channel], listener) {
-		logger.Debugf("OnBroadcast: [channel:%s, listener:%v]", channel, listener)
-		np.broadcastListeners[channel] = append(np.broadcastListeners[channel], listener)
+// OnBroadcast registers listener for all notifications of channel, every
+// call adds a listener even for the same func. The returned Subscription
+// removes it. Replay options deliver recent notifications first, flagged
+// as Replayed.
+func (np *NatsProtoo) OnBroadcast(channel string, listener BroadCastFunc, opts ...BroadcastOption) *Subscription {
+	var options broadcastOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.detectGaps {
+		listener = newSequencer(np, listener, options.reorderWindow).handle
+	}
+	if !options.replay.empty() {
+		return np.onBroadcastReplay(channel, listener, options.replay)
 	}
+	return np.OnNotification(channel, "*", listener)
 }
 
-func (np *NatsProtoo) onRequest(msg *nats.Msg) {
-	logger.Debugf("Got request [subj:%s, reply:%s]: %s", msg.Subject, msg.Reply, string(msg.Data))
-	np.handleMessage(msg.Data, msg.Subject, msg.Reply)
+// onRequest returns the handler of a channel subscription, the channel may
+// be a wildcard subject matching the subject of the message.
+func (np *NatsProtoo) onRequest(channel string) MsgHandler {
+	return func(msg *Msg) {
+		logger.Debugf("Got request [subj:%s, reply:%s]: %s", msg.Subject, msg.Reply, string(msg.Data))
+		np.handleMessage(msg.Data, channel, msg.Subject, msg.Reply)
+	}
 }
 
-func (np *NatsProtoo) handleMessage(message []byte, subj string, reply string) {
+func (np *NatsProtoo) handleMessage(message []byte, channel string, subj string, reply string) {
 	var msg PeerMsg
 	if err := json.Unmarshal(message, &msg); err != nil {
 		logger.Errorf("np.handleMessage error => %v", err)
 		return
 	}
 	if msg.Request {
-		np.handleRequest(msg.ToRequest(), subj, reply)
+		np.handleRequest(msg.ToRequest(), channel, subj, reply)
+	} else if msg.Cancel {
+		np.handleCancel(msg.ToCancel(), subj, reply)
 	} else if msg.Notification {
-		np.handleBroadcast(msg.ToNotification(), subj, reply)
+		np.handleBroadcast(msg.ToNotification(), channel, subj)
 	}
 }
 
-func (np *NatsProtoo) handleRequest(msg Request, subj string, reply string) {
+func (np *NatsProtoo) handleRequest(msg Request, channel string, subj string, reply string) {
 	logger.Debugf("Handle request [%s]", msg.Method)
+	if !np.admit(msg, channel, reply) {
+		return
+	}
+	key := idempotencyKey(msg, subj, reply)
+	if !np.beginIdempotent(key, msg, reply) {
+		return
+	}
+	done := np.track(&msg, subj, reply)
+	start := time.Now()
+
+	msg.reject = func(e *Error) {
+		defer done()
+		np.observe(channel, msg.Method, time.Since(start), e)
+		np.replyError(msg, reply, key, e)
+	}
+
 	accept := func(data interface{}) {
+		defer done()
+		np.observe(channel, msg.Method, time.Since(start), nil)
 		response, err := NewResponse(msg.ID, data)
 		if err != nil {
 			logger.Errorf("Error building response %v", err)
@@ -124,49 +208,85 @@ func (np *NatsProtoo) handleRequest(msg Request, subj string, reply string) {
 		}
 		//send accept
 		logger.Debugf("Accept [%s] => (%s)", msg.Method, payload)
-		np.Reply(payload, reply)
+		np.replyUnlessCancelled(msg, payload, reply, key)
 	}
 
 	reject := func(errorCode int, errorReason string) {
-		response := NewResponseErr(msg.ID, errorCode, errorReason)
-		payload, err := json.Marshal(response)
-		if err != nil {
-			logger.Errorf("Marshal %v", err)
-			return
-		}
-		//send reject
-		logger.Debugf("Reject [%s] => (errorCode:%d, errorReason:%s)", msg.Method, errorCode, errorReason)
-		np.Reply(payload, reply)
+		msg.reject(NewError(errorCode, errorReason))
 	}
 
-	if listener, found := np.requestListener[subj]; found {
+	np.mutex.Lock()
+	listener, found := np.requestListener[channel]
+	np.mutex.Unlock()
+	if found {
 		listener(msg, accept, reject)
 	} else {
-		reject(500, fmt.Sprintf("Not found listener for %s!", subj))
+		msg.reject(localErrorf(NoResponderCode, "Not found listener for %s!", subj))
+	}
+}
+
+func (np *NatsProtoo) replyError(msg Request, reply string, key string, e *Error) {
+	response := NewResponseErr(msg.ID, e.Code, e.Reason)
+	response.ErrorData = e.Data
+	response.NoResponder = errors.Is(e, ErrNoResponder)
+	payload, err := json.Marshal(response)
+	if err != nil {
+		logger.Errorf("Marshal %v", err)
+		return
 	}
+	//send reject
+	logger.Debugf("Reject [%s] => (errorCode:%d, errorReason:%s)", msg.Method, e.Code, e.Reason)
+	np.replyUnlessCancelled(msg, payload, reply, key)
 }
 
-func (np *NatsProtoo) handleBroadcast(data Notification, subj string, reply string) {
+// replyUnlessCancelled drops the response of a request the requestor
+// abandoned, and releases its idempotency key so that a retry is handled
+// again rather than answered with the response of the abandoned request.
+func (np *NatsProtoo) replyUnlessCancelled(msg Request, payload []byte, reply string, key string) {
+	if msg.Context().Err() != nil {
+		logger.Debugf("Drop response of cancelled request [%s] id:%d", msg.Method, msg.ID)
+		np.releaseIdempotent(key)
+		return
+	}
+	np.Reply(payload, reply)
+	np.finishIdempotent(key, payload)
+}
+
+func (np *NatsProtoo) handleBroadcast(data Notification, channel string, subj string) {
 	logger.Debugf("Handle broadcast [%s] %v", data.Method, string(data.Data))
-	if listeners, found := np.broadcastListeners[subj]; found {
-		for _, listener := range listeners {
-			listener(data, subj)
+	np.mutex.Lock()
+	var listeners []BroadCastFunc
+	for _, l := range np.notificationListeners[channel] {
+		if l.matches(data.Method) {
+			listeners = append(listeners, l.listener)
 		}
-	} else {
+	}
+	np.mutex.Unlock()
+	if len(listeners) == 0 {
 		logger.Warnf("handleBroadcast: Not found any callbacks!")
+		return
+	}
+	for _, listener := range listeners {
+		listener(data, subj)
 	}
 }
 
 // Close .
 func (np *NatsProtoo) Close() {
+	np.StopPresence()
 	np.mutex.Lock()
-	defer np.mutex.Unlock()
-	if np.closed == false {
-		logger.Infof("Close nats nc now : ", np)
-		np.nc.Close()
-		np.closed = true
-	} else {
-		logger.Warnf("Transport already closed :", np)
+	if np.closed {
+		np.mutex.Unlock()
+		logger.Warnf("Transport already closed : %v", np.subj)
+		return
+	}
+	logger.Infof("Close nats nc now : %v", np.subj)
+	np.transport.Close()
+	np.closed = true
+	np.mutex.Unlock()
+	// The NATS transport emits CloseEvent from its closed handler.
+	if np.conn() == nil {
+		np.emit(CloseEvent{Reason: "transport closed"})
 	}
 }
 
@@ -176,15 +296,12 @@ func (np *NatsProtoo) Send(message []byte, subj string, reply string) error {
 	np.mutex.Lock()
 	defer np.mutex.Unlock()
 	if np.closed {
-		return errors.New("websocket: write closed")
+		return ErrTransportClosed
 	}
-	err := np.nc.PublishRequest(subj, reply, message)
+	err := np.transport.Publish(subj, reply, message)
 	if err != nil {
-		if np.nc.LastError() != nil {
-			log.Fatalf("%v for request", np.nc.LastError())
-		}
-		log.Fatalf("%v for request", err)
-		return err
+		logger.Errorf("%v for request", err)
+		return ErrTransportClosed.Wrap(err)
 	}
 	return nil
 }
@@ -195,43 +312,64 @@ func (np *NatsProtoo) Reply(message []byte, reply string) error {
 	np.mutex.Lock()
 	defer np.mutex.Unlock()
 	if np.closed {
-		return errors.New("websocket: write closed")
+		return ErrTransportClosed
 	}
-	err := np.nc.Publish(reply, message)
+	err := np.transport.Publish(reply, _EMPTY_, message)
 	if err != nil {
-		if np.nc.LastError() != nil {
-			log.Fatalf("%v for request", np.nc.LastError())
-		}
-		log.Fatalf("%v for request", err)
-		return err
+		logger.Errorf("%v for request", err)
+		return ErrTransportClosed.Wrap(err)
 	}
 	return nil
 }
 
-func setupConnOptions(opts []nats.Option) []nats.Option {
+func (np *NatsProtoo) setupConnOptions(opts []nats.Option) []nats.Option {
 	totalWait := 10 * time.Minute
 	reconnectDelay := time.Second
 
 	opts = append(opts, nats.ReconnectWait(reconnectDelay))
 	opts = append(opts, nats.MaxReconnects(int(totalWait/reconnectDelay)))
 	opts = append(opts, nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
-		log.Printf("Disconnected due to: %s, will attempt reconnects for %.0fm", err, totalWait.Minutes())
+		logger.Warnf("Disconnected due to: %v, will attempt reconnects for %.0fm", err, totalWait.Minutes())
+		np.emit(DisconnectedEvent{Err: err})
 	}))
 	opts = append(opts, nats.ReconnectHandler(func(nc *nats.Conn) {
-		log.Printf("Reconnected [%s]", nc.ConnectedUrl())
+		logger.Infof("Reconnected [%s]", nc.ConnectedUrl())
+		np.emit(ReconnectedEvent{URL: nc.ConnectedUrl()})
+	}))
+	opts = append(opts, nats.DiscoveredServersHandler(func(nc *nats.Conn) {
+		servers := nc.DiscoveredServers()
+		logger.Infof("Discovered servers %v", servers)
+		np.emit(DiscoveredServersEvent{Servers: servers})
+	}))
+	opts = append(opts, nats.LameDuckModeHandler(func(nc *nats.Conn) {
+		logger.Warnf("Server [%s] entered lame duck mode", nc.ConnectedUrl())
+		np.emit(LameDuckEvent{URL: nc.ConnectedUrl()})
+	}))
+	opts = append(opts, nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+		subject := _EMPTY_
+		if sub != nil {
+			subject = sub.Subject
+		}
+		if err == nats.ErrSlowConsumer && sub != nil {
+			pending, _, _ := sub.Pending()
+			logger.Warnf("Slow consumer on [%s], %d pending", subject, pending)
+			np.emit(SlowConsumerEvent{Subject: subject, Pending: pending})
+			return
+		}
+		logger.Warnf("Async error on [%s] %v", subject, err)
+		np.emit(ErrorEvent{Reason: err.Error(), Subject: subject, Err: err})
 	}))
 	opts = append(opts, nats.ClosedHandler(func(nc *nats.Conn) {
-		log.Fatalf("Exiting: %v", nc.LastError())
+		logger.Warnf("%s [%v]", "nats nc closed", nc.LastError())
+		reason := "nats connection closed"
+		if nc.LastError() != nil {
+			reason = nc.LastError().Error()
+		}
+		np.mutex.Lock()
+		np.closed = true
+		np.mutex.Unlock()
+		np.emit(CloseEvent{Code: 0, Reason: reason})
 	}))
 
 	return opts
 }
-
-func listenerIsContain(items []BroadCastFunc, item BroadCastFunc) bool {
-	for _, eachItem := range items {
-		if reflect.ValueOf(eachItem) == reflect.ValueOf(item) {
-			return true
-		}
-	}
-	return false
-}
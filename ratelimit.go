@@ -0,0 +1,208 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
+)
+
+const (
+	// RateLimitedCode is the error code of requests throttled by a rate limiter.
+	RateLimitedCode = 429
+
+	callerBucketIdle = time.Minute
+)
+
+// RateLimit describes a token bucket refilled with Rate tokens per second
+// holding at most Burst tokens.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	if limit.Burst <= 0 {
+		limit.Burst = 1
+	}
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: time.Now()}
+}
+
+// take consumes a token, or returns how long to wait until one is available.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	if wait := b.wait(now); wait > 0 {
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// wait refills the bucket and returns how long to wait for a token, zero
+// if one is available.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	// now may precede the creation of the bucket.
+	elapsed := math.Max(0, now.Sub(b.last).Seconds())
+	b.last = now
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+	if b.tokens >= 1 {
+		return 0
+	}
+	if b.limit.Rate <= 0 {
+		return time.Second
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= float64(b.limit.Burst)
+}
+
+// SetRateLimit throttles requests of method sent by the requestor, an empty
+// method sets the limit of methods without their own. Throttled requests
+// are rejected locally with RateLimitedCode.
+func (req *Requestor) SetRateLimit(method string, limit RateLimit) {
+	req.mutex.Lock()
+	defer req.mutex.Unlock()
+	if req.limiters == nil {
+		req.limiters = make(map[string]*tokenBucket)
+	}
+	req.limiters[method] = newTokenBucket(limit)
+}
+
+func (req *Requestor) throttle(method string) (bool, time.Duration) {
+	req.mutex.Lock()
+	defer req.mutex.Unlock()
+	bucket, found := req.limiters[method]
+	if !found {
+		if bucket, found = req.limiters[_EMPTY_]; !found {
+			return true, 0
+		}
+	}
+	return bucket.take(time.Now())
+}
+
+// AdmissionConfig limits the request rate accepted on a channel, in total
+// and per caller. A zero Rate disables the respective limit. Callers are
+// told apart by the Peer of their requests, or else by their reply inbox,
+// which is per Requestor.
+type AdmissionConfig struct {
+	Channel RateLimit
+	Caller  RateLimit
+}
+
+type admissionController struct {
+	mutex   sync.Mutex
+	config  AdmissionConfig
+	channel *tokenBucket
+	callers map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newAdmissionController(config AdmissionConfig) *admissionController {
+	ac := &admissionController{
+		config:  config,
+		callers: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+	if config.Channel.Rate > 0 {
+		ac.channel = newTokenBucket(config.Channel)
+	}
+	return ac
+}
+
+func (ac *admissionController) admit(caller string) (bool, time.Duration) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	now := time.Now()
+	var buckets []*tokenBucket
+	if ac.config.Caller.Rate > 0 {
+		ac.sweep(now)
+		bucket, found := ac.callers[caller]
+		if !found {
+			bucket = newTokenBucket(ac.config.Caller)
+			ac.callers[caller] = bucket
+		}
+		buckets = append(buckets, bucket)
+	}
+	if ac.channel != nil {
+		buckets = append(buckets, ac.channel)
+	}
+	// Take from the buckets only if all of them have a token, so that a
+	// request refused by one limit is not charged to the other.
+	var wait time.Duration
+	for _, bucket := range buckets {
+		if w := bucket.wait(now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return true, 0
+}
+
+// sweep drops buckets of callers that have been idle long enough to refill.
+func (ac *admissionController) sweep(now time.Time) {
+	if now.Sub(ac.swept) < callerBucketIdle {
+		return
+	}
+	ac.swept = now
+	for caller, bucket := range ac.callers {
+		if bucket.full(now) {
+			delete(ac.callers, caller)
+		}
+	}
+}
+
+// SetAdmissionControl limits the rate of requests accepted on channel,
+// requests over the limit are rejected with RateLimitedCode and a
+// retry-after hint in milliseconds.
+func (np *NatsProtoo) SetAdmissionControl(channel string, config AdmissionConfig) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	np.admission[channel] = newAdmissionController(config)
+}
+
+// admit rejects the request if the admission controller of channel refuses it.
+func (np *NatsProtoo) admit(msg Request, channel string, reply string) bool {
+	np.mutex.Lock()
+	ac, found := np.admission[channel]
+	np.mutex.Unlock()
+	if !found {
+		return true
+	}
+	caller := msg.Peer
+	if caller == _EMPTY_ {
+		caller = reply
+	}
+	ok, wait := ac.admit(caller)
+	if ok {
+		return true
+	}
+	retryAfter := int(wait / time.Millisecond)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	response := NewResponseErr(msg.ID, RateLimitedCode, fmt.Sprintf("Too many requests on %s, retry after %dms", channel, retryAfter))
+	response.RetryAfter = retryAfter
+	payload, err := json.Marshal(response)
+	if err != nil {
+		logger.Errorf("Marshal %v", err)
+		return false
+	}
+	logger.Debugf("Throttle [%s] from %s, retry after %dms", msg.Method, caller, retryAfter)
+	np.Reply(payload, reply)
+	return false
+}
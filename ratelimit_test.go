@@ -0,0 +1,24 @@
+package nprotoo
+
+import "testing"
+
+func TestAdmissionRefusedByChannelKeepsCallerToken(t *testing.T) {
+	ac := newAdmissionController(AdmissionConfig{
+		Channel: RateLimit{Rate: 0.001, Burst: 1},
+		Caller:  RateLimit{Rate: 0.001, Burst: 1},
+	})
+	if ok, _ := ac.admit("alice"); !ok {
+		t.Fatalf("first request refused")
+	}
+	// The channel is out of tokens, bob must not be charged for it.
+	if ok, _ := ac.admit("bob"); ok {
+		t.Fatalf("request over the channel limit admitted")
+	}
+	if tokens := ac.callers["bob"].tokens; tokens < 1 {
+		t.Fatalf("bob charged for a refused request, %f tokens left", tokens)
+	}
+	ac.channel.tokens = 1
+	if ok, _ := ac.admit("bob"); !ok {
+		t.Fatalf("bob refused once the channel has a token")
+	}
+}
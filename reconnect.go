@@ -0,0 +1,83 @@
+package nprotoo
+
+import (
+	"github.com/cloudwebrtc/nats-protoo/logger"
+)
+
+// PendingPolicy decides what happens to in-flight requests of a Requestor
+// when the NATS connection is lost.
+type PendingPolicy int
+
+const (
+	// PendingKeep keeps pending requests with their original deadline.
+	PendingKeep PendingPolicy = iota
+	// PendingFail rejects pending requests as soon as the connection is lost.
+	PendingFail
+	// PendingResend sends pending requests of idempotent methods again
+	// after reconnecting if they were sent before the connection was lost,
+	// others are kept with their original deadline. Requests of idempotent
+	// methods carry an idempotency key, so that listeners with
+	// deduplication enabled absorb a resend of a request that got through.
+	PendingResend
+)
+
+// SetPendingPolicy sets how in-flight requests are handled across
+// reconnects, idempotentMethods lists the methods PendingResend may re-send.
+func (req *Requestor) SetPendingPolicy(policy PendingPolicy, idempotentMethods ...string) {
+	req.mutex.Lock()
+	defer req.mutex.Unlock()
+	req.pendingPolicy = policy
+	req.idempotentMethods = make(map[string]bool)
+	for _, method := range idempotentMethods {
+		req.idempotentMethods[method] = true
+	}
+}
+
+// resendable reports whether requests of method are sent again on reconnect.
+func (req *Requestor) resendable(method string) bool {
+	req.mutex.Lock()
+	defer req.mutex.Unlock()
+	return req.pendingPolicy == PendingResend && req.idempotentMethods[method]
+}
+
+func (req *Requestor) onDisconnected() {
+	req.mutex.Lock()
+	req.disconnects++
+	if req.pendingPolicy != PendingFail {
+		req.mutex.Unlock()
+		return
+	}
+	transcations := req.transcations
+	req.transcations = make(map[int]*Transcation)
+	req.mutex.Unlock()
+
+	for _, transcation := range transcations {
+		close(transcation.settled)
+		transcation.timer.Stop()
+		logger.Debugf("Fail pending transcation[%d] on disconnect", transcation.id)
+		transcation.reject(localErrorf(TransportClosedCode, "Transport disconnected, method[%s]", transcation.method))
+	}
+}
+
+func (req *Requestor) onReconnected() {
+	req.mutex.Lock()
+	if req.pendingPolicy != PendingResend {
+		req.mutex.Unlock()
+		return
+	}
+	// Requests sent while disconnected sat in the reconnect buffer and
+	// were flushed on reconnect, they must not be sent twice.
+	var resend []*Transcation
+	for _, transcation := range req.transcations {
+		if req.idempotentMethods[transcation.method] && transcation.epoch < req.disconnects {
+			transcation.epoch = req.disconnects
+			resend = append(resend, transcation)
+		}
+	}
+	req.mutex.Unlock()
+
+	for _, transcation := range resend {
+		logger.Debugf("Resend transcation[%d] after reconnect", transcation.id)
+		req.np.Send(transcation.payload, req.subj, req.reply)
+	}
+}
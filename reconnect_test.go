@@ -0,0 +1,42 @@
+package nprotoo
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPendingResend(t *testing.T) {
+	bus := NewLoopbackBus()
+	listener := NewNatsProtooWithTransport(bus.Transport())
+	defer listener.Close()
+	requestor := NewNatsProtooWithTransport(bus.Transport())
+	defer requestor.Close()
+
+	keys := make(chan string, 10)
+	listener.OnRequest("resend", func(request Request, accept RespondFunc, reject RejectFunc) {
+		// Never answer, so that the requests stay pending.
+		keys <- request.IdempotencyKey
+	})
+	var sent int32
+	spy := bus.Transport()
+	defer spy.Close()
+	spy.Subscribe("resend", func(msg *Msg) { atomic.AddInt32(&sent, 1) })
+
+	req := requestor.NewRequestor("resend")
+	req.SetPendingPolicy(PendingResend, "join")
+	req.Request("join", nil, func(RawMessage) {}, func(int, string) {})
+	if key := <-keys; key == _EMPTY_ {
+		t.Fatalf("resendable request without idempotency key")
+	}
+	requestor.emit(DisconnectedEvent{})
+	// Sent while disconnected, flushed on reconnect.
+	req.Request("join", nil, func(RawMessage) {}, func(int, string) {})
+	<-keys
+	requestor.emit(ReconnectedEvent{})
+	<-keys
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&sent); n != 3 {
+		t.Fatalf("sent %d requests, want 3", n)
+	}
+}
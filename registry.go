@@ -0,0 +1,408 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
+)
+
+const (
+	// ServiceAPIPrefix prefixes the discovery subjects of services, as in
+	// the NATS micro protocol, e.g. $SRV.INFO.<name>.<id>.
+	ServiceAPIPrefix = "$SRV"
+	// PingResponseType .
+	PingResponseType = "io.nats.micro.v1.ping_response"
+	// InfoResponseType .
+	InfoResponseType = "io.nats.micro.v1.info_response"
+	// DefaultDiscoveryWait is how long discovery collects responses.
+	DefaultDiscoveryWait = 250 * time.Millisecond
+
+	pingVerb  = "PING"
+	infoVerb  = "INFO"
+	statsVerb = "STATS"
+)
+
+var (
+	// ErrInvalidServiceName is returned for names other than [A-Za-z0-9-_]+.
+	ErrInvalidServiceName = errors.New("nprotoo: invalid service name")
+	// ErrServiceNotFound is returned when no instance of a service answered.
+	ErrServiceNotFound = errors.New("nprotoo: service not found")
+
+	serviceNameRegexp = regexp.MustCompile(`^[A-Za-z0-9\-_]+$`)
+)
+
+// Endpoint is a channel served by a service.
+type Endpoint struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	// QueueGroup is empty for nprotoo channels, which use no queue group.
+	QueueGroup string            `json:"queue_group,omitempty"`
+	Methods    []string          `json:"methods,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// ServiceConfig .
+type ServiceConfig struct {
+	Name        string
+	Version     string
+	Description string
+	Metadata    map[string]string
+	Endpoints   []Endpoint
+	// Load returns the load reported to least-loaded resolvers.
+	Load func() float64
+}
+
+// ServiceIdentity identifies an instance of a service.
+type ServiceIdentity struct {
+	Name     string            `json:"name"`
+	ID       string            `json:"id"`
+	Version  string            `json:"version"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// PingResponse .
+type PingResponse struct {
+	ServiceIdentity
+	Type string `json:"type"`
+}
+
+// ServiceInfo describes an instance of a service, it is the response to
+// $SRV.INFO requests.
+type ServiceInfo struct {
+	ServiceIdentity
+	Type        string     `json:"type"`
+	Description string     `json:"description"`
+	Endpoints   []Endpoint `json:"endpoints"`
+	Load        float64    `json:"load"`
+}
+
+// Endpoint returns the endpoint with name, an empty name returns the
+// first endpoint.
+func (info ServiceInfo) Endpoint(name string) (Endpoint, bool) {
+	for _, endpoint := range info.Endpoints {
+		if name == _EMPTY_ || endpoint.Name == name {
+			return endpoint, true
+		}
+	}
+	return Endpoint{}, false
+}
+
+// Service is a registered instance of a service, it answers discovery
+// requests until stopped.
+type Service struct {
+	np      *NatsProtoo
+	config  ServiceConfig
+	id      string
+	started time.Time
+	mutex   sync.Mutex
+	subs    []TransportSubscription
+	stopped bool
+	stats   map[string]*endpointStats
+}
+
+// RegisterService announces an instance of a service to resolvers, the
+// listeners of its endpoints are registered with OnRequest as usual.
+func (np *NatsProtoo) RegisterService(config ServiceConfig) (*Service, error) {
+	if !serviceNameRegexp.MatchString(config.Name) {
+		return nil, ErrInvalidServiceName
+	}
+	id, err := GenerateRandomString(22)
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{np: np, config: config, id: id, started: time.Now().UTC()}
+	s.resetStats()
+	handlers := map[string]MsgHandler{
+		pingVerb:  s.respond(func() interface{} { return s.ping() }),
+		infoVerb:  s.respond(func() interface{} { return s.Info() }),
+		statsVerb: s.respond(func() interface{} { return s.Stats() }),
+	}
+	for verb, handler := range handlers {
+		if err := s.subscribe(verb, handler); err != nil {
+			s.Stop()
+			return nil, ErrTransportClosed.Wrap(err)
+		}
+	}
+	np.transport.Flush()
+	np.mutex.Lock()
+	np.services = append(np.services, s)
+	np.mutex.Unlock()
+	logger.Infof("Register service %s %s id:%s", config.Name, config.Version, id)
+	return s, nil
+}
+
+// subscribe subscribes handler to the subjects of verb for all services,
+// the service name and the instance.
+func (s *Service) subscribe(verb string, handler MsgHandler) error {
+	for _, subj := range serviceSubjects(verb, s.config.Name, s.id) {
+		sub, err := s.np.transport.Subscribe(subj, handler)
+		if err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		s.subs = append(s.subs, sub)
+		s.mutex.Unlock()
+	}
+	return nil
+}
+
+func serviceSubjects(verb string, name string, id string) []string {
+	base := ServiceAPIPrefix + "." + verb
+	return []string{base, base + "." + name, base + "." + name + "." + id}
+}
+
+func (s *Service) respond(response func() interface{}) MsgHandler {
+	return func(msg *Msg) {
+		if msg.Reply == _EMPTY_ {
+			return
+		}
+		payload, err := json.Marshal(response())
+		if err != nil {
+			logger.Errorf("Marshal %v", err)
+			return
+		}
+		s.np.Reply(payload, msg.Reply)
+	}
+}
+
+// ID returns the instance ID.
+func (s *Service) ID() string {
+	return s.id
+}
+
+func (s *Service) identity() ServiceIdentity {
+	metadata := s.config.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	return ServiceIdentity{
+		Name:     s.config.Name,
+		ID:       s.id,
+		Version:  s.config.Version,
+		Metadata: metadata,
+	}
+}
+
+func (s *Service) ping() PingResponse {
+	return PingResponse{ServiceIdentity: s.identity(), Type: PingResponseType}
+}
+
+// Info .
+func (s *Service) Info() ServiceInfo {
+	info := ServiceInfo{
+		ServiceIdentity: s.identity(),
+		Type:            InfoResponseType,
+		Description:     s.config.Description,
+		Endpoints:       s.config.Endpoints,
+	}
+	if info.Endpoints == nil {
+		info.Endpoints = []Endpoint{}
+	}
+	if s.config.Load != nil {
+		info.Load = s.config.Load()
+	}
+	return info
+}
+
+// Stop withdraws the instance from discovery.
+func (s *Service) Stop() {
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		return
+	}
+	s.stopped = true
+	subs := s.subs
+	s.subs = nil
+	s.mutex.Unlock()
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+	s.np.mutex.Lock()
+	for i, service := range s.np.services {
+		if service == s {
+			s.np.services = append(s.np.services[:i:i], s.np.services[i+1:]...)
+			break
+		}
+	}
+	s.np.mutex.Unlock()
+	logger.Infof("Stop service %s id:%s", s.config.Name, s.id)
+}
+
+// DiscoverServices returns the instances of the service answering within
+// wait, all services if name is empty.
+func (np *NatsProtoo) DiscoverServices(name string, wait time.Duration) ([]ServiceInfo, error) {
+	subj := ServiceAPIPrefix + "." + infoVerb
+	if name != _EMPTY_ {
+		subj += "." + name
+	}
+	replies, err := transportGather(np.transport, subj, nil, wait)
+	if err != nil {
+		return nil, ErrTransportClosed.Wrap(err)
+	}
+	instances := make([]ServiceInfo, 0, len(replies))
+	for _, msg := range replies {
+		var info ServiceInfo
+		if err := json.Unmarshal(msg.Data, &info); err != nil {
+			logger.Warnf("Invalid service info %v", err)
+			continue
+		}
+		instances = append(instances, info)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances, nil
+}
+
+// SelectStrategy picks the instance a Resolver resolves to.
+type SelectStrategy int
+
+const (
+	// SelectRandom picks any instance.
+	SelectRandom SelectStrategy = iota
+	// SelectLeastLoaded picks the instance reporting the lowest load.
+	SelectLeastLoaded
+	// SelectSticky picks the same instance for a key as long as it is
+	// available, using rendezvous hashing.
+	SelectSticky
+)
+
+// Resolver resolves a service name to the channel of one of its instances.
+// Instances are discovered again after the refresh interval.
+type Resolver struct {
+	np        *NatsProtoo
+	name      string
+	strategy  SelectStrategy
+	refresh   time.Duration
+	wait      time.Duration
+	mutex     sync.Mutex
+	instances []ServiceInfo
+	fetched   time.Time
+}
+
+// NewResolver .
+func (np *NatsProtoo) NewResolver(name string, strategy SelectStrategy) *Resolver {
+	return &Resolver{
+		np:       np,
+		name:     name,
+		strategy: strategy,
+		refresh:  pingPeriod,
+		wait:     DefaultDiscoveryWait,
+	}
+}
+
+// SetRefreshInterval .
+func (r *Resolver) SetRefreshInterval(d time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.refresh = d
+}
+
+// SetDiscoveryWait sets how long discovery collects responses.
+func (r *Resolver) SetDiscoveryWait(d time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.wait = d
+}
+
+// Refresh discovers the instances of the service now.
+func (r *Resolver) Refresh() error {
+	r.mutex.Lock()
+	wait := r.wait
+	r.mutex.Unlock()
+	instances, err := r.np.DiscoverServices(r.name, wait)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.instances = instances
+	r.fetched = time.Now()
+	r.mutex.Unlock()
+	return nil
+}
+
+// Instances returns the known instances of the service, discovering them
+// if the refresh interval elapsed.
+func (r *Resolver) Instances() ([]ServiceInfo, error) {
+	r.mutex.Lock()
+	stale := time.Since(r.fetched) > r.refresh
+	r.mutex.Unlock()
+	if stale {
+		if err := r.Refresh(); err != nil {
+			return nil, err
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.instances, nil
+}
+
+// Resolve returns the subject of endpoint on the selected instance, key
+// is only used by SelectSticky. An empty endpoint selects the first
+// endpoint of the instance.
+func (r *Resolver) Resolve(endpoint string, key string) (string, error) {
+	instances, err := r.Instances()
+	if err != nil {
+		return _EMPTY_, err
+	}
+	var candidates []ServiceInfo
+	for _, info := range instances {
+		if _, found := info.Endpoint(endpoint); found {
+			candidates = append(candidates, info)
+		}
+	}
+	if len(candidates) == 0 {
+		return _EMPTY_, ErrServiceNotFound
+	}
+	info := r.selectInstance(candidates, key)
+	ep, _ := info.Endpoint(endpoint)
+	logger.Debugf("Resolve %s/%s => %s (instance %s)", r.name, endpoint, ep.Subject, info.ID)
+	return ep.Subject, nil
+}
+
+func (r *Resolver) selectInstance(candidates []ServiceInfo, key string) ServiceInfo {
+	switch r.strategy {
+	case SelectLeastLoaded:
+		best := candidates[0]
+		for _, info := range candidates[1:] {
+			if info.Load < best.Load {
+				best = info
+			}
+		}
+		return best
+	case SelectSticky:
+		var best ServiceInfo
+		var bestScore uint64
+		for i, info := range candidates {
+			if score := rendezvousScore(key, info.ID); i == 0 || score > bestScore {
+				best, bestScore = info, score
+			}
+		}
+		return best
+	default:
+		return candidates[rand.Intn(len(candidates))]
+	}
+}
+
+func rendezvousScore(key string, id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(id))
+	return h.Sum64()
+}
+
+// NewRequestor returns a Requestor on the resolved subject of endpoint.
+func (r *Resolver) NewRequestor(endpoint string, key string) (*Requestor, error) {
+	subj, err := r.Resolve(endpoint, key)
+	if err != nil {
+		return nil, err
+	}
+	return r.np.NewRequestor(subj), nil
+}
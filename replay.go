@@ -0,0 +1,287 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
+	nats "github.com/nats-io/nats.go"
+)
+
+const (
+	// ReplaySubjectPrefix prefixes the subject broadcasters answer replay queries on.
+	ReplaySubjectPrefix = "_NPROTOO.REPLAY."
+
+	replayTimeout = 2 * time.Second
+)
+
+// BroadcastOption configures OnBroadcast.
+type BroadcastOption func(o *broadcastOptions)
+
+type broadcastOptions struct {
+	replay        replayQuery
+	detectGaps    bool
+	reorderWindow time.Duration
+}
+
+// replayQuery selects notifications to replay, the zero value replays nothing.
+type replayQuery struct {
+	Last    int    `json:"last,omitempty"`
+	Since   int64  `json:"since,omitempty"`
+	FromSeq uint64 `json:"fromSeq,omitempty"`
+}
+
+func (q replayQuery) empty() bool {
+	return q.Last <= 0 && q.Since <= 0 && q.FromSeq == 0
+}
+
+// ReplayLast replays the last n notifications of the channel on subscribe.
+func ReplayLast(n int) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.replay.Last = n
+	}
+}
+
+// ReplaySince replays the notifications sent since t on subscribe.
+func ReplaySince(t time.Time) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.replay.Since = t.UnixNano()
+	}
+}
+
+// ReplayFromSequence replays the notifications of a durable channel from
+// JetStream stream sequence seq on subscribe, e.g. one past the last
+// StreamSeq seen. Channels replayed from the buffer of their broadcaster
+// have no stream sequence, they replay nothing for it.
+func ReplayFromSequence(seq uint64) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.replay.FromSeq = seq
+	}
+}
+
+type replayEntry struct {
+	Seq          uint64     `json:"seq"`
+	Time         int64      `json:"time"`
+	Notification RawMessage `json:"notification"`
+}
+
+// replayBuffer is the ring of recent notifications kept by a broadcaster.
+type replayBuffer struct {
+	mutex   sync.Mutex
+	entries []replayEntry
+	next    int
+	full    bool
+}
+
+func (b *replayBuffer) add(seq uint64, payload []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.entries[b.next] = replayEntry{Seq: seq, Time: time.Now().UnixNano(), Notification: payload}
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+func (b *replayBuffer) query(q replayQuery) []replayEntry {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var ordered []replayEntry
+	if b.full {
+		ordered = append(ordered, b.entries[b.next:]...)
+	}
+	ordered = append(ordered, b.entries[:b.next]...)
+	var selected []replayEntry
+	for _, e := range ordered {
+		if q.Since > 0 && e.Time < q.Since {
+			continue
+		}
+		selected = append(selected, e)
+	}
+	if q.Last > 0 && len(selected) > q.Last {
+		selected = selected[len(selected)-q.Last:]
+	}
+	return selected
+}
+
+// EnableReplay keeps the last size notifications sent by the broadcaster
+// and answers replay queries of late subscribers with them. Durable
+// broadcasters do not need it, replay is served by their stream.
+func (bc *Broadcaster) EnableReplay(size int) error {
+	if size <= 0 {
+		return NewError(BadRequestCode, "Replay buffer size must be positive")
+	}
+	buffer := &replayBuffer{entries: make([]replayEntry, size)}
+	sub, err := bc.np.transport.Subscribe(ReplaySubjectPrefix+bc.subj, func(msg *Msg) {
+		var q replayQuery
+		if err := json.Unmarshal(msg.Data, &q); err != nil {
+			logger.Warnf("Bad replay query on %s %v", bc.subj, err)
+			return
+		}
+		payload, err := json.Marshal(buffer.query(q))
+		if err != nil {
+			logger.Errorf("Marshal %v", err)
+			return
+		}
+		bc.np.transport.Publish(msg.Reply, _EMPTY_, payload)
+	})
+	if err != nil {
+		return ErrTransportClosed.Wrap(err)
+	}
+	bc.mutex.Lock()
+	bc.replay = buffer
+	bc.replaySub = sub
+	bc.mutex.Unlock()
+	return nil
+}
+
+// replayGate holds live notifications while the replay is delivered, so
+// that the listener sees replayed and live notifications in order. The
+// live subscription starts before the replay is fetched, so held
+// notifications already replayed are dropped.
+type replayGate struct {
+	mutex    sync.Mutex
+	listener BroadCastFunc
+	open     bool
+	queued   []Notification
+}
+
+func (g *replayGate) live(data Notification, subj string) {
+	g.mutex.Lock()
+	if !g.open {
+		g.queued = append(g.queued, data)
+		g.mutex.Unlock()
+		return
+	}
+	g.mutex.Unlock()
+	g.listener(data, subj)
+}
+
+func (g *replayGate) release(replayed []Notification, subj string) {
+	// Highest Seq replayed of each publisher.
+	highest := make(map[string]uint64)
+	for _, data := range replayed {
+		if data.Seq > highest[data.Publisher] {
+			highest[data.Publisher] = data.Seq
+		}
+		data.Replayed = true
+		g.listener(data, subj)
+	}
+	for {
+		g.mutex.Lock()
+		queued := g.queued
+		g.queued = nil
+		if len(queued) == 0 {
+			g.open = true
+			g.mutex.Unlock()
+			return
+		}
+		g.mutex.Unlock()
+		for _, data := range queued {
+			if data.Seq > 0 && data.Seq <= highest[data.Publisher] {
+				logger.Debugf("Drop live notification %s:%d replayed already", data.Publisher, data.Seq)
+				continue
+			}
+			g.listener(data, subj)
+		}
+	}
+}
+
+func (np *NatsProtoo) onBroadcastReplay(channel string, listener BroadCastFunc, q replayQuery) *Subscription {
+	gate := &replayGate{listener: listener}
+	sub := np.OnNotification(channel, "*", gate.live)
+	replayed, err := np.fetchReplay(channel, q)
+	if err != nil {
+		logger.Warnf("Replay on %s unavailable %v", channel, err)
+	}
+	logger.Debugf("Replay %d notifications on %s", len(replayed), channel)
+	gate.release(replayed, channel)
+	return sub
+}
+
+// fetchReplay reads the notifications selected by q from the JetStream
+// stream of the channel, or else from the replay buffer of its broadcaster.
+func (np *NatsProtoo) fetchReplay(channel string, q replayQuery) ([]Notification, error) {
+	if js, err := np.jetStream(); err == nil {
+		if info, err := js.StreamInfo(streamName(channel)); err == nil {
+			return np.fetchStreamReplay(js, channel, info.State, q)
+		}
+	}
+	if q.FromSeq > 0 && q.Last <= 0 && q.Since <= 0 {
+		logger.Warnf("Replay from sequence on %s needs a durable channel", channel)
+		return nil, nil
+	}
+	query, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := transportRequest(np.transport, ReplaySubjectPrefix+channel, query, replayTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var entries []replayEntry
+	if err := json.Unmarshal(msg.Data, &entries); err != nil {
+		return nil, err
+	}
+	var replayed []Notification
+	for _, e := range entries {
+		if data, ok := decodeNotification(e.Notification); ok {
+			replayed = append(replayed, data)
+		}
+	}
+	return replayed, nil
+}
+
+func (np *NatsProtoo) fetchStreamReplay(js nats.JetStreamContext, channel string, state nats.StreamState, q replayQuery) ([]Notification, error) {
+	if state.Msgs == 0 {
+		return nil, nil
+	}
+	var start nats.SubOpt
+	switch {
+	case q.FromSeq > state.LastSeq:
+		return nil, nil
+	case q.FromSeq > 0:
+		start = nats.StartSequence(q.FromSeq)
+	case q.Since > 0:
+		start = nats.StartTime(time.Unix(0, q.Since))
+	default:
+		seq := state.FirstSeq
+		if state.LastSeq >= uint64(q.Last) && state.LastSeq-uint64(q.Last)+1 > seq {
+			seq = state.LastSeq - uint64(q.Last) + 1
+		}
+		start = nats.StartSequence(seq)
+	}
+	sub, err := js.SubscribeSync(channel, start, nats.AckNone())
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	var replayed []Notification
+	for {
+		msg, err := sub.NextMsg(replayTimeout)
+		if err != nil {
+			// Nothing left since the requested start.
+			return replayed, nil
+		}
+		meta, err := msg.Metadata()
+		if err != nil || meta.Sequence.Stream > state.LastSeq {
+			return replayed, nil
+		}
+		if data, ok := decodeNotification(msg.Data); ok {
+			data.StreamSeq = meta.Sequence.Stream
+			replayed = append(replayed, data)
+		}
+		if meta.Sequence.Stream == state.LastSeq || meta.NumPending == 0 {
+			return replayed, nil
+		}
+	}
+}
+
+func decodeNotification(payload []byte) (Notification, bool) {
+	var msg PeerMsg
+	if err := json.Unmarshal(payload, &msg); err != nil || !msg.Notification {
+		return Notification{}, false
+	}
+	return msg.ToNotification(), true
+}
@@ -0,0 +1,37 @@
+package nprotoo
+
+import "testing"
+
+func notification(publisher string, seq uint64) Notification {
+	var data Notification
+	data.Publisher, data.Seq = publisher, seq
+	return data
+}
+
+func TestReplayGateDropsReplayedLive(t *testing.T) {
+	type delivery struct {
+		publisher string
+		seq       uint64
+		replayed  bool
+	}
+	var got []delivery
+	gate := &replayGate{listener: func(data Notification, subj string) {
+		got = append(got, delivery{data.Publisher, data.Seq, data.Replayed})
+	}}
+	// Live notifications arriving while the replay is fetched.
+	gate.live(notification("a", 2), "room")
+	gate.live(notification("b", 1), "room")
+	gate.live(notification("a", 3), "room")
+	gate.release([]Notification{notification("a", 1), notification("a", 2)}, "room")
+	gate.live(notification("a", 4), "room")
+
+	want := []delivery{{"a", 1, true}, {"a", 2, true}, {"b", 1, false}, {"a", 3, false}, {"a", 4, false}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
@@ -1,14 +1,13 @@
 package nprotoo
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"sync"
 	"time"
 
 	"github.com/chuckpreslar/emission"
 	"github.com/cloudwebrtc/nats-protoo/logger"
-	nats "github.com/nats-io/nats.go"
 )
 
 const (
@@ -18,38 +17,64 @@ const (
 
 // Requestor .
 type Requestor struct {
+	// Deprecated: use the typed callbacks or Events instead.
 	emission.Emitter
+	*eventHub
 	subj         string
 	reply        string
-	nc           *nats.Conn
 	np           *NatsProtoo
 	timeout      time.Duration
 	transcations map[int]*Transcation
 	mutex        *sync.Mutex
+	breaker      *circuitBreaker
+	limiters     map[string]*tokenBucket
+
+	pendingPolicy     PendingPolicy
+	idempotentMethods map[string]bool
+	disconnects       uint64
+
+	sub         TransportSubscription
+	token       string
+	unsubscribe func()
+	closed      bool
 }
 
-func newRequestor(channel string, np *NatsProtoo, nc *nats.Conn) *Requestor {
+func newRequestor(channel string, np *NatsProtoo) *Requestor {
 	var req Requestor
 	req.Emitter = *emission.NewEmitter()
+	req.eventHub = newEventHub(&req.Emitter)
 	req.mutex = new(sync.Mutex)
 	req.subj = channel
 	req.np = np
 	req.timeout = DefaultRequestTimeout
-	req.np.On("close", func(code int, err string) {
-		logger.Infof("Transport closed [%d] %s", code, err)
-		req.Emit("close", code, err)
-	})
-	req.np.On("error", func(code int, err string) {
-		logger.Warnf("Transport got error (%d, %s)", code, err)
-		req.Emit("error", code, err)
+	req.unsubscribe = req.np.subscribe(func(e Event) {
+		switch ev := e.(type) {
+		case CloseEvent:
+			logger.Infof("Transport closed [%d] %s", ev.Code, ev.Reason)
+		case ErrorEvent:
+			logger.Warnf("Transport got error (%d, %s)", ev.Code, ev.Reason)
+		case DisconnectedEvent:
+			req.onDisconnected()
+		case ReconnectedEvent:
+			req.onReconnected()
+		}
+		req.emit(e)
 	})
-	req.nc = nc
+	req.transcations = make(map[int]*Transcation)
 	// Sub reply inbox.
 	random, _ := GenerateRandomString(12)
+	if np.sharedReplies {
+		reply, err := np.routeReplies(&req, random)
+		if err == nil {
+			req.token = random
+			req.reply = reply
+			return &req
+		}
+		logger.Warnf("Shared reply inbox unavailable, fallback to own inbox %v", err)
+	}
 	req.reply = "requestor-id-" + random
-	req.nc.QueueSubscribe(req.reply, _EMPTY_, req.onReply)
-	req.nc.Flush()
-	req.transcations = make(map[int]*Transcation)
+	req.sub, _ = np.transport.QueueSubscribe(req.reply, _EMPTY_, req.onReply)
+	np.transport.Flush()
 	return &req
 }
 
@@ -62,15 +87,41 @@ func (req *Requestor) SetRequestTimeout(d time.Duration) {
 
 // Request .
 func (req *Requestor) Request(method string, data interface{}, success AcceptFunc, reject RejectFunc) {
+	req.RequestWithKey(method, data, _EMPTY_, success, reject)
+}
+
+// RequestWithKey sends a request carrying an idempotency key, listeners with
+// deduplication enabled replay the first response for retries with the same key.
+func (req *Requestor) RequestWithKey(method string, data interface{}, key string, success AcceptFunc, reject RejectFunc) {
+	req.request(context.Background(), method, data, key, success, func(err *Error) {
+		reject(err.Code, err.Reason)
+	})
+}
+
+func (req *Requestor) request(ctx context.Context, method string, data interface{}, key string, success AcceptFunc, reject func(err *Error)) {
+	if ok, wait := req.throttle(method); !ok {
+		logger.Debugf("Rate limited, fail request [%s]", method)
+		err := localErrorf(RateLimitedCode, "Rate limited method %s, retry after %dms", method, wait/time.Millisecond)
+		err.RetryAfter = wait
+		reject(err)
+		return
+	}
+	if key == _EMPTY_ && req.resendable(method) {
+		// Let listeners deduplicate the request if it is sent again.
+		key, _ = GenerateRandomString(16)
+	}
 	id := GenerateRandomNumber()
 	dataStr, err := json.Marshal(data)
 	if err != nil {
 		logger.Errorf("Marshal data %v", err)
+		reject(localErrorf(BadRequestCode, "%v", err).Wrap(err))
 		return
 	}
 	request := &Request{
 		RequestData: RequestData{
-			Request: true,
+			Request:        true,
+			IdempotencyKey: key,
+			Peer:           peerFromContext(ctx),
 		},
 		CommonData: CommonData{
 			ID:     id,
@@ -81,33 +132,104 @@ func (req *Requestor) Request(method string, data interface{}, success AcceptFun
 	payload, err := json.Marshal(request)
 	if err != nil {
 		logger.Errorf("Marshal %v", err)
+		reject(localErrorf(BadRequestCode, "%v", err).Wrap(err))
+		return
+	}
+	// Guard the request once it is ready to send, so that it takes a probe
+	// of a half-open circuit only if it reaches the channel.
+	success, reject, allowed := req.guard(success, reject)
+	if !allowed {
+		logger.Debugf("Circuit open, fail request [%s]", method)
+		reject(localErrorf(CircuitOpenCode, "Circuit open for channel %s", req.subj))
 		return
 	}
 
 	transcation := &Transcation{
-		id:     id,
-		accept: success,
-		reject: reject,
+		id:      id,
+		method:  method,
+		payload: payload,
+		accept:  success,
+		reject:  reject,
+		settled: make(chan struct{}),
 		close: func() {
 			logger.Infof("Transport closed !")
 		},
 	}
 
-	{
-		req.mutex.Lock()
-		defer req.mutex.Unlock()
-		req.transcations[id] = transcation
-		transcation.timer = time.AfterFunc(req.timeout, func() {
-			logger.Debugf("Request timeout transcation[%d]", transcation.id)
-			transcation.reject(480, fmt.Sprintf("Request timeout %fs transcation[%d], method[%s]", req.timeout.Seconds(), transcation.id, method))
-			req.mutex.Lock()
-			defer req.mutex.Unlock()
-			delete(req.transcations, id)
-		})
+	req.mutex.Lock()
+	if req.closed {
+		req.mutex.Unlock()
+		reject(localErrorf(TransportClosedCode, "Requestor closed, method[%s]", method))
+		return
 	}
+	timeout := req.timeout
+	transcation.epoch = req.disconnects
+	req.transcations[id] = transcation
+	transcation.timer = time.AfterFunc(timeout, func() {
+		if req.remove(id) == nil {
+			return
+		}
+		logger.Debugf("Request timeout transcation[%d]", transcation.id)
+		req.sendCancel(transcation)
+		transcation.reject(localErrorf(TimeoutCode, "Request timeout %fs transcation[%d], method[%s]", timeout.Seconds(), transcation.id, method))
+	})
+	req.mutex.Unlock()
 
 	logger.Debugf("Send request [%s]", method)
-	req.np.Send(payload, req.subj, req.reply)
+	if err := req.np.Send(payload, req.subj, req.reply); err != nil {
+		if req.remove(id) != nil {
+			transcation.timer.Stop()
+			transcation.reject(ErrTransportClosed.Wrap(err))
+		}
+		return
+	}
+	if ctx.Done() != nil {
+		go req.watchContext(ctx, transcation)
+	}
+}
+
+// Close unsubscribes the reply inbox, rejects pending requests and detaches
+// the requestor from its NatsProtoo.
+func (req *Requestor) Close() {
+	req.mutex.Lock()
+	if req.closed {
+		req.mutex.Unlock()
+		return
+	}
+	req.closed = true
+	transcations := req.transcations
+	req.transcations = make(map[int]*Transcation)
+	req.mutex.Unlock()
+
+	req.unsubscribe()
+	if req.token != _EMPTY_ {
+		req.np.unrouteReplies(req.token)
+	}
+	if req.sub != nil {
+		if err := req.sub.Unsubscribe(); err != nil {
+			logger.Warnf("Unsubscribe reply inbox %s %v", req.reply, err)
+		}
+	}
+	for _, transcation := range transcations {
+		close(transcation.settled)
+		transcation.timer.Stop()
+		transcation.reject(localErrorf(TransportClosedCode, "Requestor closed, method[%s]", transcation.method))
+	}
+	logger.Debugf("Requestor closed [%s]", req.subj)
+	req.emit(CloseEvent{Reason: "requestor closed"})
+}
+
+// remove deletes the transcation, it returns nil if it was already settled.
+func (req *Requestor) remove(id int) *Transcation {
+	req.mutex.Lock()
+	defer req.mutex.Unlock()
+	transcation, found := req.transcations[id]
+	if !found {
+		return nil
+	}
+	delete(req.transcations, id)
+	close(transcation.settled)
+	return transcation
 }
 
 // SyncRequest .
@@ -117,25 +239,36 @@ func (req *Requestor) SyncRequest(method string, data interface{}) (RawMessage,
 
 // AsyncRequest .
 func (req *Requestor) AsyncRequest(method string, data interface{}) *Future {
+	return req.AsyncRequestContext(context.Background(), method, data)
+}
+
+// AsyncRequestContext .
+func (req *Requestor) AsyncRequestContext(ctx context.Context, method string, data interface{}) *Future {
 	var future = NewFuture()
-	req.Request(method, data,
+	req.request(ctx, method, data, _EMPTY_,
 		func(resultData RawMessage) {
 			logger.Debugf("RequestAsFuture: accept [%v]", data)
 			future.resolve(resultData)
 		},
-		func(code int, reason string) {
-			logger.Debugf("RequestAsFuture: reject [%d:%s]", code, reason)
-			future.reject(&Error{code, reason})
+		func(err *Error) {
+			logger.Debugf("RequestAsFuture: reject [%d:%s]", err.Code, err.Reason)
+			future.reject(err)
 		})
 	return future
 }
 
-func (req *Requestor) onReply(msg *nats.Msg) {
+func (req *Requestor) onReply(msg *Msg) {
 	logger.Debugf("Got response [subj:%s, reply:%s]: %s", msg.Subject, msg.Reply, string(msg.Data))
 	req.handleMessage(msg.Data, msg.Subject, msg.Reply)
 }
 
 func (req *Requestor) handleMessage(message []byte, subj string, reply string) {
+	if len(message) == 0 {
+		// A NATS status without the request id, e.g. no responders, the
+		// request times out.
+		logger.Debugf("Got empty reply on %s, no responders for %s?", subj, req.subj)
+		return
+	}
 	var msg PeerMsg
 	if err := json.Unmarshal(message, &msg); err != nil {
 		logger.Errorf("handleMessage PeerMsg Unmarshal %v", err)
@@ -153,12 +286,9 @@ func (req *Requestor) handleMessage(message []byte, subj string, reply string) {
 }
 
 func (req *Requestor) handleResponse(response Response) {
-	req.mutex.Lock()
-	defer req.mutex.Unlock()
-	transcation := req.transcations[response.ID]
-
+	transcation := req.remove(response.ID)
 	if transcation == nil {
-		logger.Errorf("received response does not match any sent request [id:%d]", response.ID)
+		logger.Warnf("received response does not match any sent request [id:%d]", response.ID)
 		return
 	}
 
@@ -167,8 +297,12 @@ func (req *Requestor) handleResponse(response Response) {
 	if response.Ok {
 		transcation.accept(response.Data)
 	} else {
-		transcation.reject(response.ErrorCode, response.ErrorReason)
+		transcation.reject(&Error{
+			Code:       response.ErrorCode,
+			Reason:     response.ErrorReason,
+			Data:       response.ErrorData,
+			RetryAfter: time.Duration(response.RetryAfter) * time.Millisecond,
+			local:      response.NoResponder,
+		})
 	}
-
-	delete(req.transcations, response.ID)
 }
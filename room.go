@@ -0,0 +1,221 @@
+package nprotoo
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
+)
+
+// PeerSubjectPrefix prefixes the peer ID in the subject of a peer, it is
+// the subject served by the WebSocket bridge for the peer.
+const PeerSubjectPrefix = "peer."
+
+var (
+	// ErrPeerExists is returned by Room.Join for a peer already in the room.
+	ErrPeerExists = errors.New("nprotoo: peer already in room")
+	// ErrRoomClosed is returned by operations on a closed room.
+	ErrRoomClosed = errors.New("nprotoo: room closed")
+)
+
+// PeerSubject returns the subject requests and notifications to a peer are
+// sent on.
+func PeerSubject(peerID string) string {
+	return PeerSubjectPrefix + peerID
+}
+
+// Room keeps the peers of a room, mirroring the Room of protoo-server.
+// Each peer is addressed on its own subject, see PeerSubject.
+type Room struct {
+	id     string
+	np     *NatsProtoo
+	mutex  sync.Mutex
+	peers  map[string]*Peer
+	closed bool
+}
+
+// NewRoom .
+func (np *NatsProtoo) NewRoom(id string) *Room {
+	return &Room{
+		id:    id,
+		np:    np,
+		peers: make(map[string]*Peer),
+	}
+}
+
+// ID .
+func (r *Room) ID() string {
+	return r.id
+}
+
+// Join adds the peer to the room.
+func (r *Room) Join(peerID string) (*Peer, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return nil, ErrRoomClosed
+	}
+	if _, found := r.peers[peerID]; found {
+		return nil, ErrPeerExists
+	}
+	subject := PeerSubject(peerID)
+	peer := &Peer{
+		id:          peerID,
+		room:        r,
+		requestor:   r.np.NewRequestor(subject),
+		broadcaster: r.np.NewBroadcaster(subject),
+	}
+	r.peers[peerID] = peer
+	logger.Debugf("Peer %s joined room %s", peerID, r.id)
+	return peer, nil
+}
+
+// Leave removes the peer from the room, pending requests to it are
+// rejected.
+func (r *Room) Leave(peerID string) {
+	r.mutex.Lock()
+	peer, found := r.peers[peerID]
+	delete(r.peers, peerID)
+	r.mutex.Unlock()
+	if found {
+		logger.Debugf("Peer %s left room %s", peerID, r.id)
+		peer.close()
+	}
+}
+
+// Peer returns the peer with peerID, or nil if it is not in the room.
+func (r *Room) Peer(peerID string) *Peer {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.peers[peerID]
+}
+
+// HasPeer .
+func (r *Room) HasPeer(peerID string) bool {
+	return r.Peer(peerID) != nil
+}
+
+// Peers returns the peers in the room.
+func (r *Room) Peers() []*Peer {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	peers := make([]*Peer, 0, len(r.peers))
+	for _, peer := range r.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Broadcast notifies all peers in the room.
+func (r *Room) Broadcast(method string, data interface{}) error {
+	return r.BroadcastExcept(_EMPTY_, method, data)
+}
+
+// BroadcastExcept notifies all peers in the room but exclude, typically
+// the peer that caused the notification. The first error is returned
+// after all peers were notified.
+func (r *Room) BroadcastExcept(exclude string, method string, data interface{}) error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return ErrRoomClosed
+	}
+	peers := make([]*Peer, 0, len(r.peers))
+	for id, peer := range r.peers {
+		if id != exclude {
+			peers = append(peers, peer)
+		}
+	}
+	r.mutex.Unlock()
+	var first error
+	for _, peer := range peers {
+		if err := peer.Notify(method, data); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Request sends a request to a single peer of the room.
+func (r *Room) Request(peerID string, method string, data interface{}) *Future {
+	peer := r.Peer(peerID)
+	if peer == nil {
+		future := NewFuture()
+		future.reject(Errorf(NotFoundCode, "Peer %s not in room %s", peerID, r.id))
+		return future
+	}
+	return peer.AsyncRequest(method, data)
+}
+
+// Close removes all peers and closes the room.
+func (r *Room) Close() {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return
+	}
+	r.closed = true
+	peers := r.peers
+	r.peers = make(map[string]*Peer)
+	r.mutex.Unlock()
+	for _, peer := range peers {
+		peer.close()
+	}
+	logger.Debugf("Room %s closed", r.id)
+}
+
+// Peer is a member of a Room, mirroring the Peer of protoo-server.
+type Peer struct {
+	id          string
+	room        *Room
+	requestor   *Requestor
+	broadcaster *Broadcaster
+}
+
+// ID .
+func (p *Peer) ID() string {
+	return p.id
+}
+
+// Room .
+func (p *Peer) Room() *Room {
+	return p.room
+}
+
+// Subject returns the subject of the peer, see PeerSubject.
+func (p *Peer) Subject() string {
+	return PeerSubject(p.id)
+}
+
+// AsyncRequest sends a request to the peer.
+func (p *Peer) AsyncRequest(method string, data interface{}) *Future {
+	return p.requestor.AsyncRequest(method, data)
+}
+
+// AsyncRequestContext sends a request to the peer which is abandoned when
+// ctx is done.
+func (p *Peer) AsyncRequestContext(ctx context.Context, method string, data interface{}) *Future {
+	return p.requestor.AsyncRequestContext(ctx, method, data)
+}
+
+// SyncRequest .
+func (p *Peer) SyncRequest(method string, data interface{}) (RawMessage, *Error) {
+	return p.requestor.SyncRequest(method, data)
+}
+
+// Notify sends a notification to the peer.
+func (p *Peer) Notify(method string, data interface{}) error {
+	_, err := p.broadcaster.Say(method, data)
+	return err
+}
+
+// Leave removes the peer from its room.
+func (p *Peer) Leave() {
+	p.room.Leave(p.id)
+}
+
+func (p *Peer) close() {
+	p.requestor.Close()
+	p.broadcaster.Close()
+}
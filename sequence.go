@@ -0,0 +1,186 @@
+package nprotoo
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
+)
+
+// GapEvent is emitted by the NatsProtoo when a listener with gap detection
+// sees notifications of a publisher out of sequence. Duplicate is set for a
+// notification already seen, which is dropped.
+type GapEvent struct {
+	Channel   string
+	Publisher string
+	Expected  uint64
+	Received  uint64
+	Duplicate bool
+}
+
+func (e GapEvent) legacy() (string, []interface{}) {
+	return "gap", []interface{}{e.Channel, e.Publisher, e.Expected, e.Received}
+}
+
+// OnGap registers fn for GapEvent, the returned func removes it.
+func (h *eventHub) OnGap(fn func(GapEvent)) (remove func()) {
+	return h.subscribe(func(e Event) {
+		if ev, ok := e.(GapEvent); ok {
+			fn(ev)
+		}
+	})
+}
+
+// DetectGaps emits a GapEvent when notifications of a publisher are missing
+// or duplicated, duplicates are not delivered.
+func DetectGaps() BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.detectGaps = true
+	}
+}
+
+// Reorder holds notifications arriving ahead of sequence for up to window
+// waiting for the missing ones, a GapEvent is emitted when they never come.
+func Reorder(window time.Duration) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.detectGaps = true
+		o.reorderWindow = window
+	}
+}
+
+// nextSequence stamps the next sequence number of channel for this publisher.
+func (np *NatsProtoo) nextSequence(channel string) uint64 {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	np.sequences[channel]++
+	return np.sequences[channel]
+}
+
+// sequenceKey identifies a sequence, publishers number their notifications
+// per channel.
+type sequenceKey struct {
+	channel   string
+	publisher string
+}
+
+type publisherState struct {
+	expected uint64
+	held     []Notification
+	timer    *time.Timer
+}
+
+// sequencer checks the sequence of notifications per publisher and channel
+// before passing them to the listener.
+type sequencer struct {
+	mutex      sync.Mutex
+	np         *NatsProtoo
+	listener   BroadCastFunc
+	window     time.Duration
+	publishers map[sequenceKey]*publisherState
+}
+
+func newSequencer(np *NatsProtoo, listener BroadCastFunc, window time.Duration) *sequencer {
+	return &sequencer{
+		np:         np,
+		listener:   listener,
+		window:     window,
+		publishers: make(map[sequenceKey]*publisherState),
+	}
+}
+
+func (s *sequencer) handle(data Notification, subj string) {
+	if data.Seq == 0 || data.Publisher == _EMPTY_ {
+		s.listener(data, subj)
+		return
+	}
+	key := sequenceKey{channel: subj, publisher: data.Publisher}
+	s.mutex.Lock()
+	state, found := s.publishers[key]
+	if !found {
+		state = &publisherState{expected: data.Seq}
+		s.publishers[key] = state
+	}
+	switch {
+	case data.Seq < state.expected || s.isHeld(state, data.Seq):
+		s.mutex.Unlock()
+		logger.Debugf("Drop duplicate notification [%s] seq:%d on %s", data.Method, data.Seq, subj)
+		s.np.emit(GapEvent{Channel: subj, Publisher: data.Publisher, Expected: state.expected, Received: data.Seq, Duplicate: true})
+		return
+	case data.Seq == state.expected:
+		state.expected++
+		ready := append([]Notification{data}, s.drain(state)...)
+		s.mutex.Unlock()
+		s.deliver(ready, subj)
+		return
+	}
+	if s.window <= 0 {
+		expected := state.expected
+		state.expected = data.Seq + 1
+		s.mutex.Unlock()
+		s.np.emit(GapEvent{Channel: subj, Publisher: data.Publisher, Expected: expected, Received: data.Seq})
+		s.listener(data, subj)
+		return
+	}
+	state.held = append(state.held, data)
+	sort.Slice(state.held, func(i, j int) bool { return state.held[i].Seq < state.held[j].Seq })
+	if state.timer == nil {
+		state.timer = time.AfterFunc(s.window, func() {
+			s.expire(key)
+		})
+	}
+	s.mutex.Unlock()
+}
+
+func (s *sequencer) isHeld(state *publisherState, seq uint64) bool {
+	for _, held := range state.held {
+		if held.Seq == seq {
+			return true
+		}
+	}
+	return false
+}
+
+// drain pops held notifications that are now in sequence, the caller must
+// hold s.mutex.
+func (s *sequencer) drain(state *publisherState) []Notification {
+	var ready []Notification
+	for len(state.held) > 0 && state.held[0].Seq == state.expected {
+		ready = append(ready, state.held[0])
+		state.held = state.held[1:]
+		state.expected++
+	}
+	if len(state.held) == 0 && state.timer != nil {
+		state.timer.Stop()
+		state.timer = nil
+	}
+	return ready
+}
+
+// expire gives up on the missing notifications once the window elapsed.
+func (s *sequencer) expire(key sequenceKey) {
+	s.mutex.Lock()
+	state := s.publishers[key]
+	state.timer = nil
+	if len(state.held) == 0 {
+		s.mutex.Unlock()
+		return
+	}
+	expected, received := state.expected, state.held[0].Seq
+	state.expected = received
+	ready := s.drain(state)
+	if len(state.held) > 0 {
+		state.timer = time.AfterFunc(s.window, func() {
+			s.expire(key)
+		})
+	}
+	s.mutex.Unlock()
+	s.np.emit(GapEvent{Channel: key.channel, Publisher: key.publisher, Expected: expected, Received: received})
+	s.deliver(ready, key.channel)
+}
+
+func (s *sequencer) deliver(ready []Notification, subj string) {
+	for _, data := range ready {
+		s.listener(data, subj)
+	}
+}
@@ -0,0 +1,108 @@
+package nprotoo
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type sequenceRecorder struct {
+	mutex sync.Mutex
+	got   []string
+}
+
+func (r *sequenceRecorder) listener(data Notification, subj string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.got = append(r.got, subj+":"+data.Method)
+}
+
+func (r *sequenceRecorder) delivered() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.got...)
+}
+
+func sequenced(method string, publisher string, seq uint64) Notification {
+	data := notification(publisher, seq)
+	data.Method = method
+	return data
+}
+
+func expectDelivered(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("delivered %v, want %v", got, want)
+		}
+	}
+}
+
+func newTestSequencer(t *testing.T, window time.Duration) (*sequencer, *sequenceRecorder, chan GapEvent) {
+	np := NewNatsProtooWithTransport(NewLoopbackTransport())
+	t.Cleanup(np.Close)
+	gaps := make(chan GapEvent, 10)
+	np.OnGap(func(e GapEvent) { gaps <- e })
+	r := &sequenceRecorder{}
+	return newSequencer(np, r.listener, window), r, gaps
+}
+
+func TestSequencerPerChannel(t *testing.T) {
+	s, r, gaps := newTestSequencer(t, 0)
+	s.handle(sequenced("a1", "p", 1), "room.a")
+	s.handle(sequenced("a2", "p", 2), "room.a")
+	s.handle(sequenced("b1", "p", 1), "room.b")
+	expectDelivered(t, r.delivered(), "room.a:a1", "room.a:a2", "room.b:b1")
+	if len(gaps) != 0 {
+		t.Fatalf("unexpected gap %v", <-gaps)
+	}
+}
+
+func TestSequencerDuplicatesAndGaps(t *testing.T) {
+	s, r, gaps := newTestSequencer(t, 0)
+	s.handle(sequenced("1", "p", 1), "room")
+	s.handle(sequenced("1", "p", 1), "room")
+	if e := <-gaps; !e.Duplicate || e.Received != 1 {
+		t.Fatalf("got %+v, want duplicate", e)
+	}
+	s.handle(sequenced("3", "p", 3), "room")
+	if e := <-gaps; e.Duplicate || e.Expected != 2 || e.Received != 3 {
+		t.Fatalf("got %+v, want gap", e)
+	}
+	expectDelivered(t, r.delivered(), "room:1", "room:3")
+}
+
+func TestSequencerReorder(t *testing.T) {
+	s, r, gaps := newTestSequencer(t, time.Minute)
+	s.handle(sequenced("1", "p", 1), "room")
+	s.handle(sequenced("3", "p", 3), "room")
+	s.handle(sequenced("2", "p", 2), "room")
+	expectDelivered(t, r.delivered(), "room:1", "room:2", "room:3")
+	if len(gaps) != 0 {
+		t.Fatalf("unexpected gap %v", <-gaps)
+	}
+}
+
+func TestSequencerReorderExpires(t *testing.T) {
+	s, r, gaps := newTestSequencer(t, 20*time.Millisecond)
+	s.handle(sequenced("1", "p", 1), "room")
+	s.handle(sequenced("3", "p", 3), "room")
+	expectDelivered(t, r.delivered(), "room:1")
+	select {
+	case e := <-gaps:
+		if e.Channel != "room" || e.Expected != 2 || e.Received != 3 {
+			t.Fatalf("got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no gap after the reorder window")
+	}
+	// The held notification is delivered right after the gap is emitted.
+	deadline := time.Now().Add(time.Second)
+	for len(r.delivered()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	expectDelivered(t, r.delivered(), "room:1", "room:3")
+}
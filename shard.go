@@ -0,0 +1,324 @@
+package nprotoo
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
+)
+
+const (
+	defaultShardReplicas = 100
+)
+
+// ShardConfig .
+type ShardConfig struct {
+	// Channel returns the channel a node serves its shards on, e.g.
+	// "sfu-" + nodeID. Live nodes with a listener on it form the ring.
+	Channel func(nodeID string) string
+	// Replicas is the number of points of each node on the ring, more
+	// points spread keys more evenly. Defaults to 100.
+	Replicas int
+}
+
+// RebalanceEvent is passed to rebalance callbacks when the nodes of the
+// ring change.
+type RebalanceEvent struct {
+	Joined []string
+	Left   []string
+	// Nodes are the nodes of the new ring.
+	Nodes []string
+	prev  *hashRing
+	next  *hashRing
+}
+
+// Moved reports whether key is owned by another node since the rebalance,
+// with the previous and the new owner.
+func (e RebalanceEvent) Moved(key string) (from string, to string, moved bool) {
+	from, to = e.prev.owner(key), e.next.owner(key)
+	return from, to, from != to
+}
+
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+	nodes  []string
+}
+
+func newHashRing(nodes []string, replicas int) *hashRing {
+	ring := &hashRing{owners: make(map[uint32]string), nodes: nodes}
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			point := ringHash(node + "#" + strconv.Itoa(i))
+			if _, taken := ring.owners[point]; taken {
+				continue
+			}
+			ring.owners[point] = node
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// owner returns the node owning key, the first point clockwise of its hash.
+func (ring *hashRing) owner(key string) string {
+	if len(ring.points) == 0 {
+		return _EMPTY_
+	}
+	hash := ringHash(key)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.owners[ring.points[i]]
+}
+
+// ShardedRequestor sends requests to the node owning their routing key on
+// a consistent-hash ring of the live nodes known from presence, see
+// StartPresence.
+type ShardedRequestor struct {
+	np          *NatsProtoo
+	config      ShardConfig
+	syncMutex   sync.Mutex
+	mutex       sync.Mutex
+	ring        *hashRing
+	requestors  map[string]*Requestor
+	timeout     time.Duration
+	nextID      uint64
+	callbacks   map[uint64]func(RebalanceEvent)
+	unsubscribe func()
+	stop        chan struct{}
+	closed      bool
+}
+
+// NewShardedRequestor .
+func (np *NatsProtoo) NewShardedRequestor(config ShardConfig) *ShardedRequestor {
+	if config.Replicas <= 0 {
+		config.Replicas = defaultShardReplicas
+	}
+	sr := &ShardedRequestor{
+		np:         np,
+		config:     config,
+		ring:       newHashRing(nil, config.Replicas),
+		requestors: make(map[string]*Requestor),
+		callbacks:  make(map[uint64]func(RebalanceEvent)),
+		stop:       make(chan struct{}),
+	}
+	sr.unsubscribe = np.subscribe(func(e Event) {
+		switch e.(type) {
+		case NodeUpEvent, NodeDownEvent:
+			sr.sync()
+		}
+	})
+	sr.sync()
+	go sr.run()
+	return sr
+}
+
+// run catches nodes starting or stopping to serve the shard channel.
+func (sr *ShardedRequestor) run() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sr.stop:
+			return
+		case <-ticker.C:
+			sr.sync()
+		}
+	}
+}
+
+// members returns the IDs of the live nodes serving the shard channel.
+func (sr *ShardedRequestor) members() []string {
+	nodes := append(sr.np.Nodes(), sr.np.localNode())
+	var members []string
+	for _, node := range nodes {
+		channel := sr.config.Channel(node.ID)
+		for _, c := range node.Channels {
+			if c == channel {
+				members = append(members, node.ID)
+				break
+			}
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// sync rebuilds the ring if its nodes changed and runs the rebalance
+// callbacks.
+func (sr *ShardedRequestor) sync() {
+	sr.syncMutex.Lock()
+	defer sr.syncMutex.Unlock()
+	members := sr.members()
+	sr.mutex.Lock()
+	if sr.closed || equalStrings(members, sr.ring.nodes) {
+		sr.mutex.Unlock()
+		return
+	}
+	prev := sr.ring
+	next := newHashRing(members, sr.config.Replicas)
+	sr.ring = next
+	event := RebalanceEvent{Nodes: members, prev: prev, next: next}
+	current := make(map[string]bool, len(members))
+	for _, node := range members {
+		current[node] = true
+	}
+	for _, node := range prev.nodes {
+		if !current[node] {
+			event.Left = append(event.Left, node)
+		}
+	}
+	previous := make(map[string]bool, len(prev.nodes))
+	for _, node := range prev.nodes {
+		previous[node] = true
+	}
+	for _, node := range members {
+		if !previous[node] {
+			event.Joined = append(event.Joined, node)
+		}
+	}
+	var stale []*Requestor
+	for _, node := range event.Left {
+		if req, found := sr.requestors[node]; found {
+			delete(sr.requestors, node)
+			stale = append(stale, req)
+		}
+	}
+	callbacks := make([]func(RebalanceEvent), 0, len(sr.callbacks))
+	for _, fn := range sr.callbacks {
+		callbacks = append(callbacks, fn)
+	}
+	sr.mutex.Unlock()
+
+	logger.Infof("Rebalance ring, joined %v, left %v", event.Joined, event.Left)
+	for _, req := range stale {
+		req.Close()
+	}
+	for _, fn := range callbacks {
+		fn(event)
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// OnRebalance registers fn for ring changes, the returned func removes it.
+func (sr *ShardedRequestor) OnRebalance(fn func(RebalanceEvent)) (remove func()) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	sr.nextID++
+	id := sr.nextID
+	sr.callbacks[id] = fn
+	return func() {
+		sr.mutex.Lock()
+		defer sr.mutex.Unlock()
+		delete(sr.callbacks, id)
+	}
+}
+
+// SetRequestTimeout sets the timeout of the requestors of all nodes.
+func (sr *ShardedRequestor) SetRequestTimeout(d time.Duration) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	sr.timeout = d
+	for _, req := range sr.requestors {
+		req.SetRequestTimeout(d)
+	}
+}
+
+// Nodes returns the nodes of the ring.
+func (sr *ShardedRequestor) Nodes() []string {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	return sr.ring.nodes
+}
+
+// Owner returns the node owning key, empty if the ring has no nodes.
+func (sr *ShardedRequestor) Owner(key string) string {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	return sr.ring.owner(key)
+}
+
+// requestor returns the requestor of the node owning key.
+func (sr *ShardedRequestor) requestor(key string) (*Requestor, *Error) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	if sr.closed {
+		return nil, localErrorf(TransportClosedCode, "Sharded requestor closed")
+	}
+	node := sr.ring.owner(key)
+	if node == _EMPTY_ {
+		return nil, localErrorf(NoResponderCode, "No node for key %s", key)
+	}
+	req, found := sr.requestors[node]
+	if !found {
+		req = sr.np.NewRequestor(sr.config.Channel(node))
+		if sr.timeout > 0 {
+			req.SetRequestTimeout(sr.timeout)
+		}
+		sr.requestors[node] = req
+	}
+	return req, nil
+}
+
+// AsyncRequest sends a request to the node owning key, e.g. the room ID.
+func (sr *ShardedRequestor) AsyncRequest(key string, method string, data interface{}) *Future {
+	return sr.AsyncRequestContext(context.Background(), key, method, data)
+}
+
+// AsyncRequestContext .
+func (sr *ShardedRequestor) AsyncRequestContext(ctx context.Context, key string, method string, data interface{}) *Future {
+	req, err := sr.requestor(key)
+	if err != nil {
+		future := NewFuture()
+		future.reject(err)
+		return future
+	}
+	return req.AsyncRequestContext(ctx, method, data)
+}
+
+// SyncRequest .
+func (sr *ShardedRequestor) SyncRequest(key string, method string, data interface{}) (RawMessage, *Error) {
+	return sr.AsyncRequest(key, method, data).Await()
+}
+
+// Close closes the requestors of all nodes.
+func (sr *ShardedRequestor) Close() {
+	sr.mutex.Lock()
+	if sr.closed {
+		sr.mutex.Unlock()
+		return
+	}
+	sr.closed = true
+	requestors := sr.requestors
+	sr.requestors = make(map[string]*Requestor)
+	sr.mutex.Unlock()
+	close(sr.stop)
+	sr.unsubscribe()
+	for _, req := range requestors {
+		req.Close()
+	}
+}
@@ -0,0 +1,47 @@
+package nprotoo
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHashRingOwner(t *testing.T) {
+	ring := newHashRing([]string{"a", "b", "c"}, defaultShardReplicas)
+	if empty := newHashRing(nil, defaultShardReplicas); empty.owner("key") != _EMPTY_ {
+		t.Fatalf("empty ring owns key")
+	}
+	owners := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := "room-" + strconv.Itoa(i)
+		owner := ring.owner(key)
+		if owner != ring.owner(key) {
+			t.Fatalf("owner of %s not stable", key)
+		}
+		owners[owner]++
+	}
+	for _, node := range []string{"a", "b", "c"} {
+		if owners[node] < 300 {
+			t.Fatalf("node %s owns %d of 3000 keys", node, owners[node])
+		}
+	}
+}
+
+func TestRebalanceMovesOnlyToJoinedNode(t *testing.T) {
+	prev := newHashRing([]string{"a", "b", "c"}, defaultShardReplicas)
+	next := newHashRing([]string{"a", "b", "c", "d"}, defaultShardReplicas)
+	event := RebalanceEvent{Joined: []string{"d"}, Nodes: next.nodes, prev: prev, next: next}
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		from, to, ok := event.Moved("room-" + strconv.Itoa(i))
+		if !ok {
+			continue
+		}
+		if to != "d" {
+			t.Fatalf("key moved from %s to %s, not to the joined node", from, to)
+		}
+		moved++
+	}
+	if moved == 0 || moved > 1500 {
+		t.Fatalf("%d of 3000 keys moved to the joined node", moved)
+	}
+}
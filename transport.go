@@ -0,0 +1,137 @@
+package nprotoo
+
+import (
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// Msg is a message received from a Transport.
+type Msg struct {
+	Subject string
+	Reply   string
+	Data    []byte
+}
+
+// MsgHandler .
+type MsgHandler func(msg *Msg)
+
+// TransportSubscription .
+type TransportSubscription interface {
+	Unsubscribe() error
+}
+
+// Transport carries the messages of a NatsProtoo. Subjects follow the NATS
+// rules: tokens separated by ".", "*" matches one token and ">" the rest.
+// Subscribers sharing a non-empty queue name receive each message once
+// between them.
+type Transport interface {
+	Publish(subj string, reply string, data []byte) error
+	Subscribe(subj string, handler MsgHandler) (TransportSubscription, error)
+	QueueSubscribe(subj string, queue string, handler MsgHandler) (TransportSubscription, error)
+	Flush() error
+	Close()
+}
+
+// NoJetStreamCode is the error code of JetStream backed features used on
+// other transports.
+const NoJetStreamCode = 501
+
+// ErrNoJetStream is returned by JetStream backed features on other transports.
+var ErrNoJetStream = &Error{Code: NoJetStreamCode, Reason: "JetStream requires the NATS transport", local: true}
+
+// NatsTransport is the Transport over a NATS connection.
+type NatsTransport struct {
+	nc *nats.Conn
+}
+
+// NewNatsTransport .
+func NewNatsTransport(nc *nats.Conn) *NatsTransport {
+	return &NatsTransport{nc: nc}
+}
+
+// Conn returns the underlying NATS connection.
+func (t *NatsTransport) Conn() *nats.Conn {
+	return t.nc
+}
+
+// Publish .
+func (t *NatsTransport) Publish(subj string, reply string, data []byte) error {
+	if reply == _EMPTY_ {
+		return t.nc.Publish(subj, data)
+	}
+	return t.nc.PublishRequest(subj, reply, data)
+}
+
+// Subscribe .
+func (t *NatsTransport) Subscribe(subj string, handler MsgHandler) (TransportSubscription, error) {
+	return t.QueueSubscribe(subj, _EMPTY_, handler)
+}
+
+// QueueSubscribe .
+func (t *NatsTransport) QueueSubscribe(subj string, queue string, handler MsgHandler) (TransportSubscription, error) {
+	return t.nc.QueueSubscribe(subj, queue, func(msg *nats.Msg) {
+		handler(&Msg{Subject: msg.Subject, Reply: msg.Reply, Data: msg.Data})
+	})
+}
+
+// Flush .
+func (t *NatsTransport) Flush() error {
+	return t.nc.Flush()
+}
+
+// Close .
+func (t *NatsTransport) Close() {
+	t.nc.Close()
+}
+
+// transportRequest publishes data on subj and waits for the first reply.
+func transportRequest(t Transport, subj string, data []byte, timeout time.Duration) (*Msg, error) {
+	inbox := nats.NewInbox()
+	replies := make(chan *Msg, 1)
+	sub, err := t.Subscribe(inbox, func(msg *Msg) {
+		select {
+		case replies <- msg:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	if err := t.Publish(subj, inbox, data); err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-replies:
+		return msg, nil
+	case <-time.After(timeout):
+		return nil, nats.ErrTimeout
+	}
+}
+
+// transportGather publishes data on subj and collects the replies arriving
+// within wait.
+func transportGather(t Transport, subj string, data []byte, wait time.Duration) ([]*Msg, error) {
+	inbox := nats.NewInbox()
+	var mutex sync.Mutex
+	var replies []*Msg
+	sub, err := t.Subscribe(inbox, func(msg *Msg) {
+		mutex.Lock()
+		replies = append(replies, msg)
+		mutex.Unlock()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Publish(subj, inbox, data); err != nil {
+		sub.Unsubscribe()
+		return nil, err
+	}
+	time.Sleep(wait)
+	sub.Unsubscribe()
+	mutex.Lock()
+	defer mutex.Unlock()
+	return replies, nil
+}
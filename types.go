@@ -1,9 +1,12 @@
 package nprotoo
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"time"
+
+	"github.com/cloudwebrtc/nats-protoo/logger"
 )
 
 type RawMessage []byte
@@ -27,13 +30,15 @@ func (m *RawMessage) UnmarshalJSON(data []byte) error {
 
 func (r RawMessage) Unmarshal(msgType interface{}) *Error {
 	if err := json.Unmarshal(r, &msgType); err != nil {
-		return &Error{Code: 400, Reason: err.Error()}
+		return &Error{Code: BadRequestCode, Reason: err.Error(), cause: err}
 	}
 	return nil
 }
 
 // AcceptFunc .
 type AcceptFunc func(data RawMessage)
+
+// RespondFunc .
 type RespondFunc func(data interface{})
 
 // RejectFunc .
@@ -49,12 +54,16 @@ type PeerMsg struct {
 	RequestData
 	ResponseData
 	NotificationData
+	CancelData
 	CommonData
 }
 
 type RequestData struct {
-	Request   bool   `json:"request"`
-	ReplySubj string `json:"reply"`
+	Request        bool   `json:"request"`
+	ReplySubj      string `json:"reply"`
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// Peer identifies the WebSocket peer a bridged request originates from.
+	Peer string `json:"peer,omitempty"`
 }
 
 type ResponseData struct {
@@ -64,12 +73,29 @@ type ResponseData struct {
 }
 
 type ResponseErrData struct {
-	ErrorCode   int    `json:"errorCode"`
-	ErrorReason string `json:"errorReason"`
+	ErrorCode   int        `json:"errorCode"`
+	ErrorReason string     `json:"errorReason"`
+	ErrorData   RawMessage `json:"errorData,omitempty"`
+	RetryAfter  int        `json:"retryAfter,omitempty"`
+	// NoResponder is set when the listener has no request listener for the
+	// channel, so that requestors raise ErrNoResponder.
+	NoResponder bool `json:"noResponder,omitempty"`
 }
 
 type NotificationData struct {
 	Notification bool `json:"notification"`
+	// Replayed is set on notifications delivered by a replay on subscribe.
+	Replayed bool `json:"replayed,omitempty"`
+	// Seq numbers the notifications of Publisher on a channel from 1.
+	Seq       uint64 `json:"seq,omitempty"`
+	Publisher string `json:"publisher,omitempty"`
+	// StreamSeq is the JetStream stream sequence of notifications received
+	// from the stream of a durable channel, see ReplayFromSequence.
+	StreamSeq uint64 `json:"-"`
+}
+
+type CancelData struct {
+	Cancel bool `json:"cancel,omitempty"`
 }
 
 type CommonData struct {
@@ -82,10 +108,33 @@ func (m PeerMsg) ToNotification() Notification {
 	return Notification{NotificationData: m.NotificationData, CommonData: m.CommonData}
 }
 
+func (m PeerMsg) ToCancel() Cancel {
+	return Cancel{CancelData: m.CancelData, CommonData: m.CommonData}
+}
+
 func (m PeerMsg) ToRequest() Request {
 	return Request{RequestData: m.RequestData, CommonData: m.CommonData}
 }
 
+// RejectError rejects the request with the code, reason and structured
+// data of e, in place of the RejectFunc passed to the listener.
+func (r Request) RejectError(e *Error) {
+	if r.reject == nil {
+		logger.Warnf("RejectError on request [%s] not being handled", r.Method)
+		return
+	}
+	r.reject(e)
+}
+
+// Context returns the context of the request, it is cancelled when the
+// requestor abandons the request, even while the listener blocks.
+func (r Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
 func NewResponse(id int, data interface{}) (*Response, error) {
 	dataStr, err := json.Marshal(data)
 	if err != nil {
@@ -138,6 +187,8 @@ func NewResponseErr(id int, errorCode int, errorReason string) *Response {
 type Request struct {
 	RequestData
 	CommonData
+	ctx    context.Context
+	reject func(e *Error)
 }
 
 /*
@@ -172,6 +223,18 @@ type ResponseError struct {
 	CommonData
 }
 
+/*
+* Cancel
+{
+  cancel : true,
+  id     : 12345678
+}
+*/
+type Cancel struct {
+	CancelData
+	CommonData
+}
+
 /*
 * Notification
 {
@@ -190,9 +253,14 @@ type Notification struct {
 
 // Transcation .
 type Transcation struct {
-	id     int
-	accept AcceptFunc
-	reject RejectFunc
-	close  func()
-	timer  *time.Timer
+	id      int
+	method  string
+	payload []byte
+	accept  AcceptFunc
+	reject  func(err *Error)
+	close   func()
+	timer   *time.Timer
+	settled chan struct{}
+	// epoch is the number of disconnects of the requestor before it was sent.
+	epoch uint64
 }
@@ -0,0 +1,203 @@
+// Package wsbridge serves protoo-client peers over WebSocket and forwards
+// their traffic to nprotoo: peer requests are sent on a channel, and
+// notifications broadcast on the subject of a peer are pushed to it.
+//
+// Backends send requests to a connected peer with a Requestor on the peer
+// subject, the response of the peer is routed back to the Requestor:
+//
+//	np.NewRequestor(nprotoo.PeerSubject(peerID)).SyncRequest("getStats", nil)
+//
+// With the default peer subject, peers of a nprotoo Room are reached this way.
+package wsbridge
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+
+	nprotoo "github.com/cloudwebrtc/nats-protoo"
+	"github.com/cloudwebrtc/nats-protoo/logger"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Subprotocol is the WebSocket subprotocol of protoo-client.
+	Subprotocol = "protoo"
+	// DefaultPeerSubjectPrefix prefixes the peer ID in the default peer
+	// subject, matching the subjects of nprotoo Room peers.
+	DefaultPeerSubjectPrefix = nprotoo.PeerSubjectPrefix
+)
+
+var (
+	// ErrNoPeerID is returned by the default PeerID func when the handshake
+	// has no peerId query parameter.
+	ErrNoPeerID = errors.New("wsbridge: missing peerId")
+	// ErrInvalidPeerID is returned for peer IDs which are not a single
+	// subject token, such as "a.b", "*" or ">".
+	ErrInvalidPeerID = errors.New("wsbridge: invalid peerId")
+)
+
+// Config .
+type Config struct {
+	// Channel receives the requests of all peers, Request.Peer holds the
+	// ID of the sending peer.
+	Channel string
+	// PeerSubject returns the subject broadcasts and requests to a peer are
+	// sent on, defaults to DefaultPeerSubjectPrefix followed by the peer ID.
+	// Subjects outside nprotoo.PeerSubjectPrefix are announced in presence
+	// heartbeats like any other request channel.
+	PeerSubject func(peerID string) string
+	// PeerID identifies the peer of a handshake, defaults to the peerId
+	// query parameter used by protoo-client URLs.
+	PeerID func(r *http.Request) (string, error)
+	// CheckOrigin is passed to the WebSocket upgrader, nil only accepts
+	// same-origin handshakes.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Bridge is an http.Handler accepting protoo-client WebSocket connections.
+type Bridge struct {
+	np        *nprotoo.NatsProtoo
+	config    Config
+	upgrader  websocket.Upgrader
+	requestor *nprotoo.Requestor
+	mutex     sync.Mutex
+	peers     map[string]*peer
+	closed    bool
+}
+
+// NewBridge returns a bridge forwarding peer requests to config.Channel.
+func NewBridge(np *nprotoo.NatsProtoo, config Config) *Bridge {
+	if config.PeerSubject == nil {
+		config.PeerSubject = func(peerID string) string {
+			return DefaultPeerSubjectPrefix + peerID
+		}
+	}
+	if config.PeerID == nil {
+		config.PeerID = peerIDFromQuery
+	}
+	return &Bridge{
+		np:     np,
+		config: config,
+		upgrader: websocket.Upgrader{
+			Subprotocols: []string{Subprotocol},
+			CheckOrigin:  config.CheckOrigin,
+		},
+		requestor: np.NewRequestor(config.Channel),
+		peers:     make(map[string]*peer),
+	}
+}
+
+func peerIDFromQuery(r *http.Request) (string, error) {
+	peerID := r.URL.Query().Get("peerId")
+	if peerID == "" {
+		return "", ErrNoPeerID
+	}
+	return peerID, validatePeerID(peerID)
+}
+
+// validatePeerID rejects peer IDs that would widen the peer subject, e.g.
+// "%3E" subscribing to the notifications and requests of all peers.
+func validatePeerID(peerID string) error {
+	if peerID == "" || strings.ContainsAny(peerID, ".*>") {
+		return ErrInvalidPeerID
+	}
+	for _, r := range peerID {
+		if unicode.IsSpace(r) {
+			return ErrInvalidPeerID
+		}
+	}
+	return nil
+}
+
+// ServeHTTP upgrades the request to a protoo WebSocket connection, an
+// existing connection of the same peer is closed.
+func (b *Bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !hasSubprotocol(r) {
+		http.Error(w, "Invalid/missing Sec-WebSocket-Protocol", http.StatusBadRequest)
+		return
+	}
+	peerID, err := b.config.PeerID(r)
+	if err == nil {
+		err = validatePeerID(peerID)
+	}
+	if err != nil {
+		logger.Warnf("Reject WebSocket from %s: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warnf("WebSocket upgrade from %s failed: %v", r.RemoteAddr, err)
+		return
+	}
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	p := newPeer(b, peerID, conn)
+	old := b.peers[peerID]
+	b.peers[peerID] = p
+	b.mutex.Unlock()
+	if old != nil {
+		logger.Infof("Replace connection of peer %s", peerID)
+		old.close()
+	}
+	logger.Infof("Peer %s connected from %s", peerID, r.RemoteAddr)
+	p.run()
+}
+
+func hasSubprotocol(r *http.Request) bool {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol == Subprotocol {
+			return true
+		}
+	}
+	return false
+}
+
+// remove forgets p unless it was replaced by a newer connection, it
+// returns whether p was the current connection of the peer.
+func (b *Bridge) remove(p *peer) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.peers[p.id] != p {
+		return false
+	}
+	delete(b.peers, p.id)
+	return true
+}
+
+// Peers returns the IDs of the connected peers.
+func (b *Bridge) Peers() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ids := make([]string, 0, len(b.peers))
+	for id := range b.peers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Close disconnects all peers and stops accepting new ones.
+func (b *Bridge) Close() {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return
+	}
+	b.closed = true
+	peers := make([]*peer, 0, len(b.peers))
+	for _, p := range b.peers {
+		peers = append(peers, p)
+	}
+	b.mutex.Unlock()
+	for _, p := range peers {
+		p.close()
+	}
+	b.requestor.Close()
+}
@@ -0,0 +1,65 @@
+package wsbridge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cloudwebrtc/nats-protoo/nprotootest"
+	"github.com/gorilla/websocket"
+)
+
+func dial(t *testing.T, srv *httptest.Server, peerID string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + "/?peerId=" + url.QueryEscape(peerID)
+	dialer := websocket.Dialer{Subprotocols: []string{Subprotocol}}
+	return dialer.Dial(u, nil)
+}
+
+func TestInvalidPeerID(t *testing.T) {
+	_, np := nprotootest.LoopbackPair(t)
+	b := NewBridge(np, Config{Channel: "room"})
+	defer b.Close()
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+
+	for _, peerID := range []string{"", ">", "*", "peer.>", "a.b", "a b", "a\tb"} {
+		conn, resp, err := dial(t, srv, peerID)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("peerId %q: accepted", peerID)
+		}
+		if resp == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("peerId %q: got %v %v", peerID, resp, err)
+		}
+	}
+	conn, _, err := dial(t, srv, "alice")
+	if err != nil {
+		t.Fatalf("peerId alice: %v", err)
+	}
+	conn.Close()
+}
+
+func TestInvalidCustomPeerID(t *testing.T) {
+	_, np := nprotootest.LoopbackPair(t)
+	b := NewBridge(np, Config{
+		Channel: "room",
+		PeerID: func(r *http.Request) (string, error) {
+			return r.URL.Query().Get("user") + ".>", nil
+		},
+	})
+	defer b.Close()
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+
+	conn, resp, err := dial(t, srv, "alice")
+	if err == nil {
+		conn.Close()
+		t.Fatalf("custom peer id accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("custom peer id: got %v %v", resp, err)
+	}
+}
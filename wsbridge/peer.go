@@ -0,0 +1,247 @@
+package wsbridge
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	nprotoo "github.com/cloudwebrtc/nats-protoo"
+	"github.com/cloudwebrtc/nats-protoo/logger"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait     = 10 * time.Second
+	pongWait      = 60 * time.Second
+	pingPeriod    = pongWait * 9 / 10
+	sendQueueSize = 256
+)
+
+// peer is the WebSocket connection of a protoo-client.
+type peer struct {
+	id     string
+	bridge *Bridge
+	conn   *websocket.Conn
+	send   chan []byte
+	ctx    context.Context
+	cancel context.CancelFunc
+	sub    *nprotoo.Subscription
+	once   sync.Once
+
+	mutex   sync.Mutex
+	pending map[int]pendingRequest
+}
+
+func newPeer(b *Bridge, id string, conn *websocket.Conn) *peer {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &peer{
+		id:      id,
+		bridge:  b,
+		conn:    conn,
+		send:    make(chan []byte, sendQueueSize),
+		ctx:     nprotoo.WithPeer(ctx, id),
+		cancel:  cancel,
+		pending: make(map[int]pendingRequest),
+	}
+	subject := b.config.PeerSubject(id)
+	p.sub = b.np.OnBroadcast(subject, p.onNotification)
+	b.np.OnRequest(subject, p.onRequest)
+	return p
+}
+
+// run forwards frames of the peer until the connection is closed.
+func (p *peer) run() {
+	go p.writeLoop()
+	p.readLoop()
+}
+
+func (p *peer) readLoop() {
+	defer p.close()
+	p.conn.SetReadDeadline(time.Now().Add(pongWait))
+	p.conn.SetPongHandler(func(string) error {
+		return p.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, message, err := p.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logger.Warnf("Peer %s read error %v", p.id, err)
+			}
+			return
+		}
+		p.handleMessage(message)
+	}
+}
+
+func (p *peer) writeLoop() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case message := <-p.send:
+			p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := p.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				logger.Warnf("Peer %s write error %v", p.id, err)
+				p.close()
+				return
+			}
+		case <-ticker.C:
+			p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := p.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				p.close()
+				return
+			}
+		case <-p.ctx.Done():
+			p.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+			p.conn.Close()
+			return
+		}
+	}
+}
+
+func (p *peer) handleMessage(message []byte) {
+	var msg nprotoo.PeerMsg
+	if err := json.Unmarshal(message, &msg); err != nil {
+		logger.Errorf("Peer %s sent invalid frame %v", p.id, err)
+		return
+	}
+	if msg.Request {
+		p.handleRequest(msg.ToRequest())
+	} else if msg.Response {
+		p.handleResponse(msg)
+	} else {
+		logger.Debugf("Ignore frame of peer %s: %s", p.id, string(message))
+	}
+}
+
+// handleRequest sends the request of the peer on the bridge channel, it is
+// cancelled if the peer disconnects first.
+func (p *peer) handleRequest(request nprotoo.Request) {
+	logger.Debugf("Peer %s request [%s]", p.id, request.Method)
+	future := p.bridge.requestor.AsyncRequestContext(p.ctx, request.Method, request.Data)
+	future.Then(func(result nprotoo.RawMessage) {
+		response, err := nprotoo.NewResponse(request.ID, result)
+		if err != nil {
+			logger.Errorf("Error building response %v", err)
+			return
+		}
+		p.write(response)
+	}, func(err *nprotoo.Error) {
+		response := nprotoo.NewResponseErr(request.ID, err.Code, err.Reason)
+		response.ErrorData = err.Data
+		p.write(response)
+	})
+}
+
+// onRequest forwards a request on the peer subject to the peer, its
+// response is matched by handleResponse.
+func (p *peer) onRequest(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+	id := nprotoo.GenerateRandomNumber()
+	p.mutex.Lock()
+	p.pending[id] = pendingRequest{request: request, accept: accept}
+	p.mutex.Unlock()
+	frame := &nprotoo.Request{
+		RequestData: nprotoo.RequestData{
+			Request: true,
+		},
+		CommonData: nprotoo.CommonData{
+			ID:     id,
+			Method: request.Method,
+			Data:   request.Data,
+		},
+	}
+	logger.Debugf("Request [%s] to peer %s", request.Method, p.id)
+	if !p.write(frame) {
+		if _, found := p.settle(id); found {
+			reject(nprotoo.TransportClosedCode, "Peer "+p.id+" unavailable")
+		}
+		return
+	}
+	go func() {
+		// The context is done once the request is answered or abandoned.
+		<-request.Context().Done()
+		p.settle(id)
+	}()
+}
+
+func (p *peer) handleResponse(msg nprotoo.PeerMsg) {
+	pending, found := p.settle(msg.ID)
+	if !found {
+		logger.Debugf("Drop response of peer %s to unknown request id:%d", p.id, msg.ID)
+		return
+	}
+	if msg.Ok {
+		pending.accept(msg.Data)
+		return
+	}
+	pending.request.RejectError(nprotoo.NewError(msg.ErrorCode, msg.ErrorReason).WithData(msg.ErrorData))
+}
+
+// pendingRequest is a request sent to the peer awaiting its response.
+type pendingRequest struct {
+	request nprotoo.Request
+	accept  nprotoo.RespondFunc
+}
+
+// settle removes a pending request to the peer and returns it.
+func (p *peer) settle(id int) (pendingRequest, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pending, found := p.pending[id]
+	if found {
+		delete(p.pending, id)
+	}
+	return pending, found
+}
+
+func (p *peer) onNotification(data nprotoo.Notification, subj string) {
+	notification := &nprotoo.Notification{
+		NotificationData: nprotoo.NotificationData{
+			Notification: true,
+		},
+		CommonData: nprotoo.CommonData{
+			Method: data.Method,
+			Data:   data.Data,
+		},
+	}
+	p.write(notification)
+}
+
+// write queues a frame, it is dropped if the peer is gone or too slow.
+func (p *peer) write(frame interface{}) bool {
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		logger.Errorf("Marshal %v", err)
+		return false
+	}
+	if p.ctx.Err() != nil {
+		return false
+	}
+	select {
+	case p.send <- payload:
+		return true
+	default:
+		logger.Warnf("Peer %s send queue full, drop frame", p.id)
+		return false
+	}
+}
+
+func (p *peer) close() {
+	p.once.Do(func() {
+		logger.Infof("Peer %s disconnected", p.id)
+		p.cancel()
+		p.sub.Unsubscribe()
+		if p.bridge.remove(p) {
+			p.bridge.np.OffRequest(p.bridge.config.PeerSubject(p.id))
+		}
+		p.mutex.Lock()
+		pending := p.pending
+		p.pending = make(map[int]pendingRequest)
+		p.mutex.Unlock()
+		for _, req := range pending {
+			req.request.RejectError(nprotoo.Errorf(nprotoo.TransportClosedCode, "Peer %s disconnected", p.id))
+		}
+	})
+}